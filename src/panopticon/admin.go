@@ -0,0 +1,301 @@
+// Copyright © 2019 Dan Morrill
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panopticon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"playground/httputil"
+	"playground/log"
+)
+
+/*
+ * Administration API
+ *
+ * These endpoints manage the Cameras, Users, and Settings tables, and are
+ * restricted to privileged users. Cameras and Users are read from the
+ * database on every request, and settings are applied as they're stored, so
+ * changes take effect immediately.
+ *
+ *   GET /api/config                 -- current settings, as a map of key to value
+ *   PUT /api/config                 -- update some or all settings; "" reverts one to config
+ *   GET /api/cameras/               -- list all cameras
+ *   GET/PUT/DELETE /api/cameras/ID  -- fetch, create or update, or remove a camera
+ *   GET /api/cameras/ID/key         -- list a camera's API keys (see keys.go)
+ *   POST /api/cameras/ID/key        -- rotate a camera's API key, with optional ?grace=24h
+ *   DELETE /api/cameras/ID/key      -- revoke all of a camera's keys, or just ?prefix=...
+ *   GET /api/cameras/ID/status      -- how server-side capture from a camera is going (see poller.go)
+ *   GET /api/cameras/ID/zones       -- list a camera's motion zones (see zones.go)
+ *   PUT /api/cameras/ID/zones       -- replace all of a camera's motion zones with a list of them
+ *   PUT/DELETE /api/cameras/ID/zones/NAME -- create or replace, or remove, one motion zone
+ *   GET /api/users/                 -- list all users
+ *   GET/PUT/DELETE /api/users/EMAIL -- fetch, create or update, or remove a user
+ *
+ * PUTs of cameras and users are merged onto the existing row (if any), so a
+ * request need only include the fields it wants to change.
+ */
+
+// requirePrivileged asserts that the request is from a privileged user, returning that user.
+func requirePrivileged(writer http.ResponseWriter, req *http.Request, TAG string) *User {
+	forbidden := httputil.NewJSONAssertable(writer, TAG, http.StatusForbidden, notPrivileged)
+	u := userFor(req)
+	forbidden.Assert(u != nil && u.Privileged, "attempt by unprivileged user to access %s", req.URL.Path)
+	return u
+}
+
+// sendInvalid reports a validation failure to the client, including the reason since it's likely
+// actionable.
+func sendInvalid(writer http.ResponseWriter, TAG string, err error) {
+	log.Warn(TAG, "rejecting invalid request", err)
+	httputil.SendJSON(writer, http.StatusBadRequest, &APIResponse{Error: &APIError{Message: err.Error(), Extra: "", Recoverable: true}})
+}
+
+// ConfigHandler handles /api/config
+func ConfigHandler(writer http.ResponseWriter, req *http.Request) {
+	TAG := "panopticon.ConfigHandler"
+	badReq := httputil.NewJSONAssertable(writer, TAG, http.StatusBadRequest, clientError)
+	notAllowed := httputil.NewJSONAssertable(writer, TAG, http.StatusMethodNotAllowed, badMethod)
+
+	requirePrivileged(writer, req, TAG)
+
+	switch req.Method {
+	case "GET":
+	case "PUT":
+		settings := make(map[string]string)
+		err := json.NewDecoder(req.Body).Decode(&settings)
+		badReq.Assert(err == nil, "malformed settings (%s)", err)
+
+		// check everything before storing anything, so a bad request doesn't half-apply
+		for k, v := range settings {
+			if err := System.ValidateSetting(k, v); err != nil {
+				sendInvalid(writer, TAG, err)
+				return
+			}
+		}
+		for k, v := range settings {
+			if err := System.SetSetting(k, v); err != nil {
+				panic(err) // already validated
+			}
+			log.Status(TAG, fmt.Sprintf("set '%s' to '%s'", k, v))
+		}
+	default:
+		notAllowed.Assert(false, "unsupported method %s", req.Method)
+	}
+
+	httputil.SendJSON(writer, http.StatusOK, &APIResponse{Artifact: System.Settings()})
+}
+
+// CameraConfigHandler handles /api/cameras/
+func CameraConfigHandler(writer http.ResponseWriter, req *http.Request) {
+	TAG := "panopticon.CameraConfigHandler"
+	badReq := httputil.NewJSONAssertable(writer, TAG, http.StatusBadRequest, clientError)
+	notFound := httputil.NewJSONAssertable(writer, TAG, http.StatusNotFound, noSuchCamera)
+	notAllowed := httputil.NewJSONAssertable(writer, TAG, http.StatusMethodNotAllowed, badMethod)
+
+	requirePrivileged(writer, req, TAG)
+
+	camID := httputil.ExtractSegment(req.URL.Path, 3)
+	if camID == "" {
+		notAllowed.Assert(req.Method == "GET", "unsupported method %s on camera list", req.Method)
+		httputil.SendJSON(writer, http.StatusOK, &APIResponse{Artifact: System.Cameras()})
+		return
+	}
+
+	cam := System.GetCamera(camID)
+	if httputil.ExtractSegment(req.URL.Path, 4) == "key" {
+		notFound.Assert(cam != nil, "unknown camera '%s'", camID)
+		cameraKeyConfig(writer, req, cam)
+		return
+	}
+	if httputil.ExtractSegment(req.URL.Path, 4) == "zones" {
+		notFound.Assert(cam != nil, "unknown camera '%s'", camID)
+		cameraZoneConfig(writer, req, cam, httputil.ExtractSegment(req.URL.Path, 5))
+		return
+	}
+	if httputil.ExtractSegment(req.URL.Path, 4) == "status" {
+		notFound.Assert(cam != nil, "unknown camera '%s'", camID)
+		notAllowed.Assert(req.Method == "GET", "unsupported method %s on camera status", req.Method)
+		httputil.SendJSON(writer, http.StatusOK, &APIResponse{Artifact: cam.CaptureStatus()})
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		notFound.Assert(cam != nil, "unknown camera '%s'", camID)
+		httputil.SendJSON(writer, http.StatusOK, &APIResponse{Artifact: cam})
+	case "PUT":
+		status := http.StatusOK
+		if cam == nil {
+			status = http.StatusCreated
+			cam = &Camera{ID: camID, AspectRatio: string(Aspect16x9), Timelapse: "none", Private: true}
+		}
+		err := json.NewDecoder(req.Body).Decode(cam)
+		badReq.Assert(err == nil, "malformed camera (%s)", err)
+		badReq.Assert(cam.ID == camID, "attempt to change ID of camera '%s' to '%s'", camID, cam.ID)
+		if err := cam.Validate(); err != nil {
+			sendInvalid(writer, TAG, err)
+			return
+		}
+		cam.Store()
+		log.Status(TAG, fmt.Sprintf("stored camera '%s'", cam.ID))
+		httputil.SendJSON(writer, status, &APIResponse{Artifact: cam})
+	case "DELETE":
+		notFound.Assert(cam != nil, "unknown camera '%s'", camID)
+		cam.Delete()
+		log.Status(TAG, fmt.Sprintf("deleted camera '%s'", cam.ID))
+		httputil.SendJSON(writer, http.StatusOK, &APIResponse{Artifact: struct{}{}})
+	default:
+		notAllowed.Assert(false, "unsupported method %s", req.Method)
+	}
+}
+
+// cameraKeyConfig handles /api/cameras/ID/key for CameraConfigHandler.
+func cameraKeyConfig(writer http.ResponseWriter, req *http.Request, cam *Camera) {
+	TAG := "panopticon.cameraKeyConfig"
+	badReq := httputil.NewJSONAssertable(writer, TAG, http.StatusBadRequest, clientError)
+	notFound := httputil.NewJSONAssertable(writer, TAG, http.StatusNotFound, clientError)
+	notAllowed := httputil.NewJSONAssertable(writer, TAG, http.StatusMethodNotAllowed, badMethod)
+
+	res := &struct {
+		Key  string `json:",omitempty"`
+		Keys []*CameraKey
+	}{}
+	switch req.Method {
+	case "GET":
+	case "POST":
+		var grace time.Duration
+		if raw := req.URL.Query().Get("grace"); raw != "" {
+			var err error
+			grace, err = ParseRetention(raw)
+			badReq.Assert(err == nil, "invalid grace period '%s' (%s)", raw, err)
+		}
+		res.Key = cam.RotateKey(grace)
+		log.Status(TAG, fmt.Sprintf("rotated key for camera '%s' with grace period %s", cam.ID, grace))
+	case "DELETE":
+		if prefix := req.URL.Query().Get("prefix"); prefix != "" {
+			notFound.Assert(cam.RevokeKey(prefix), "no key '%s' for camera '%s'", prefix, cam.ID)
+			log.Status(TAG, fmt.Sprintf("revoked key '%s' for camera '%s'", prefix, cam.ID))
+		} else {
+			cam.RevokeKeys()
+			log.Status(TAG, fmt.Sprintf("revoked all keys for camera '%s'", cam.ID))
+		}
+	default:
+		notAllowed.Assert(false, "unsupported method %s", req.Method)
+	}
+
+	res.Keys = cam.Keys()
+	httputil.SendJSON(writer, http.StatusOK, &APIResponse{Artifact: res})
+}
+
+// cameraZoneConfig handles /api/cameras/ID/zones for CameraConfigHandler; `name` is the zone named
+// in the path, if any.
+func cameraZoneConfig(writer http.ResponseWriter, req *http.Request, cam *Camera, name string) {
+	TAG := "panopticon.cameraZoneConfig"
+	badReq := httputil.NewJSONAssertable(writer, TAG, http.StatusBadRequest, clientError)
+	notFound := httputil.NewJSONAssertable(writer, TAG, http.StatusNotFound, clientError)
+	notAllowed := httputil.NewJSONAssertable(writer, TAG, http.StatusMethodNotAllowed, badMethod)
+
+	switch {
+	case req.Method == "GET" && name == "":
+	case req.Method == "PUT" && name == "":
+		zones := []*MotionZone{}
+		err := json.NewDecoder(req.Body).Decode(&zones)
+		badReq.Assert(err == nil, "malformed zones (%s)", err)
+		seen := map[string]bool{}
+		for _, z := range zones {
+			if err := z.Validate(); err != nil {
+				sendInvalid(writer, TAG, err)
+				return
+			}
+			badReq.Assert(!seen[z.Name], "duplicate zone '%s'", z.Name)
+			seen[z.Name] = true
+		}
+		cam.ClearMotionZones()
+		for _, z := range zones {
+			cam.StoreMotionZone(z)
+		}
+		log.Status(TAG, fmt.Sprintf("stored %d zones for camera '%s'", len(zones), cam.ID))
+	case req.Method == "PUT":
+		z := &MotionZone{Name: name, Active: true}
+		err := json.NewDecoder(req.Body).Decode(z)
+		badReq.Assert(err == nil, "malformed zone (%s)", err)
+		badReq.Assert(z.Name == name, "attempt to rename zone '%s' to '%s'", name, z.Name)
+		if err := z.Validate(); err != nil {
+			sendInvalid(writer, TAG, err)
+			return
+		}
+		cam.StoreMotionZone(z)
+		log.Status(TAG, fmt.Sprintf("stored zone '%s' for camera '%s'", z.Name, cam.ID))
+	case req.Method == "DELETE" && name != "":
+		notFound.Assert(cam.DeleteMotionZone(name), "no zone '%s' for camera '%s'", name, cam.ID)
+		log.Status(TAG, fmt.Sprintf("deleted zone '%s' for camera '%s'", name, cam.ID))
+	default:
+		notAllowed.Assert(false, "unsupported method %s on zones", req.Method)
+	}
+
+	httputil.SendJSON(writer, http.StatusOK, &APIResponse{Artifact: cam.MotionZones()})
+}
+
+// UserConfigHandler handles /api/users/
+func UserConfigHandler(writer http.ResponseWriter, req *http.Request) {
+	TAG := "panopticon.UserConfigHandler"
+	badReq := httputil.NewJSONAssertable(writer, TAG, http.StatusBadRequest, clientError)
+	notFound := httputil.NewJSONAssertable(writer, TAG, http.StatusNotFound, clientError)
+	notAllowed := httputil.NewJSONAssertable(writer, TAG, http.StatusMethodNotAllowed, badMethod)
+
+	me := requirePrivileged(writer, req, TAG)
+
+	email := httputil.ExtractSegment(req.URL.Path, 3)
+	if email == "" {
+		notAllowed.Assert(req.Method == "GET", "unsupported method %s on user list", req.Method)
+		httputil.SendJSON(writer, http.StatusOK, &APIResponse{Artifact: System.Users()})
+		return
+	}
+
+	u := System.GetUser(email)
+	switch req.Method {
+	case "GET":
+		notFound.Assert(u != nil, "unknown user '%s'", email)
+		httputil.SendJSON(writer, http.StatusOK, &APIResponse{Artifact: u})
+	case "PUT":
+		status := http.StatusOK
+		if u == nil {
+			status = http.StatusCreated
+			u = &User{Email: email}
+		}
+		err := json.NewDecoder(req.Body).Decode(u)
+		badReq.Assert(err == nil, "malformed user (%s)", err)
+		badReq.Assert(u.Email == email, "attempt to change email of user '%s' to '%s'", email, u.Email)
+		badReq.Assert(u.Email != me.Email || u.Privileged, "attempt by '%s' to revoke own privileges", me.Email)
+		if err := u.Validate(); err != nil {
+			sendInvalid(writer, TAG, err)
+			return
+		}
+		u.Store()
+		log.Status(TAG, fmt.Sprintf("stored user '%s'", u.Email))
+		httputil.SendJSON(writer, status, &APIResponse{Artifact: u})
+	case "DELETE":
+		notFound.Assert(u != nil, "unknown user '%s'", email)
+		badReq.Assert(u.Email != me.Email, "attempt by '%s' to delete self", me.Email)
+		u.Delete()
+		log.Status(TAG, fmt.Sprintf("deleted user '%s'", u.Email))
+		httputil.SendJSON(writer, http.StatusOK, &APIResponse{Artifact: struct{}{}})
+	default:
+		notAllowed.Assert(false, "unsupported method %s", req.Method)
+	}
+}
@@ -0,0 +1,335 @@
+// Copyright © 2019 Dan Morrill
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panopticon
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"playground/log"
+)
+
+/*
+ * Archives
+ *
+ * An archive is a tar file for moving media between instances. Its first
+ * entry is always `manifest.json`, an ArchiveManifest describing everything
+ * else in the file; the rest are the data files themselves, stored as
+ * `media/{{.Camera}}/{{.Handle}}.jpg` (and `.webm`, `.mp4`, etc. for each
+ * rendition of its video, if there is one).
+ * Each image appears once, even if it is pinned as several kinds.
+ */
+
+const archiveVersion = 1
+const archiveManifestName = "manifest.json"
+
+// ArchiveManifest describes the contents of an archive written by Export.
+type ArchiveManifest struct {
+	Version int
+	Created time.Time
+	Cameras []*ArchiveCamera
+	Items   []*ArchiveItem
+}
+
+// ArchiveCamera describes a camera whose media is in an archive. It has only descriptive fields; how
+// the camera is reached (e.g. its StillURL and RTSPURL, which carry its credentials) stays behind.
+type ArchiveCamera struct {
+	ID          string
+	Name        string
+	AspectRatio string
+	Latitude    float64
+	Longitude   float64
+	Diurnal     bool
+	Timelapse   MediaKind
+	Private     bool
+}
+
+func archiveCamera(cam *Camera) *ArchiveCamera {
+	return &ArchiveCamera{
+		ID:          cam.ID,
+		Name:        cam.Name,
+		AspectRatio: cam.AspectRatio,
+		Latitude:    cam.Latitude,
+		Longitude:   cam.Longitude,
+		Diurnal:     cam.Diurnal,
+		Timelapse:   cam.Timelapse,
+		Private:     cam.Private,
+	}
+}
+
+// camera returns a new Camera as described.
+func (ac *ArchiveCamera) camera() *Camera {
+	return &Camera{
+		ID:          ac.ID,
+		Name:        ac.Name,
+		AspectRatio: ac.AspectRatio,
+		Latitude:    ac.Latitude,
+		Longitude:   ac.Longitude,
+		Diurnal:     ac.Diurnal,
+		Timelapse:   ac.Timelapse,
+		Private:     ac.Private,
+	}
+}
+
+// ArchiveItem describes a single image (and its video, if any) in an archive.
+type ArchiveItem struct {
+	Handle   string
+	Camera   string
+	Kinds    []MediaKind
+	Captured time.Time
+	HasVideo bool
+
+	// Renditions lists the renditions of the video, e.g. "webm" and "mp4"; if empty, a video is
+	// understood to be WebM only
+	Renditions []string
+}
+
+func (item *ArchiveItem) stillName() string {
+	return path.Join("media", item.Camera, fmt.Sprintf("%s.jpg", item.Handle))
+}
+
+func (item *ArchiveItem) videoName(ext string) string {
+	return path.Join("media", item.Camera, fmt.Sprintf("%s.%s", item.Handle, ext))
+}
+
+// videoExts lists the extensions of all the renditions of the item's video.
+func (item *ArchiveItem) videoExts() []string {
+	if !item.HasVideo {
+		return nil
+	}
+	if len(item.Renditions) < 1 {
+		return []string{"webm"}
+	}
+	return item.Renditions
+}
+
+// Export writes an archive of the media from the indicated cameras (or all cameras, if none are
+// given) pinned as any of the indicated kinds, and captured within [from, to). Zero times leave that
+// end of the range open. Returns the number of images written.
+func (repo *RepositoryConfig) Export(w io.Writer, cameras []string, kinds []MediaKind, from time.Time, to time.Time) int {
+	manifest := &ArchiveManifest{Version: archiveVersion, Created: time.Now()}
+
+	if len(cameras) < 1 {
+		for _, cam := range System.Cameras() {
+			cameras = append(cameras, cam.ID)
+		}
+	}
+	items := make(map[string]*ArchiveItem)
+	for _, id := range cameras {
+		cam := System.GetCamera(id)
+		if cam == nil {
+			panic(fmt.Errorf("attempt to export unknown camera '%s'", id))
+		}
+		manifest.Cameras = append(manifest.Cameras, archiveCamera(cam))
+
+		for _, kind := range kinds {
+			for _, img := range repo.ListKindBetween(id, kind, from, to) {
+				key := fmt.Sprintf("%s/%s", img.Source, img.Handle)
+				item, ok := items[key]
+				if !ok {
+					item = &ArchiveItem{Handle: img.Handle, Camera: img.Source, Captured: img.Timestamp, HasVideo: img.HasVideo}
+					for _, ext := range videoRenditions {
+						if img.HasVideo && img.HasRendition(ext) {
+							item.Renditions = append(item.Renditions, ext)
+						}
+					}
+					items[key] = item
+					manifest.Items = append(manifest.Items, item)
+				}
+				item.Kinds = append(item.Kinds, kind)
+			}
+		}
+	}
+	sort.Slice(manifest.Items, func(i, j int) bool { return manifest.Items[i].Captured.Before(manifest.Items[j].Captured) })
+
+	tw := tar.NewWriter(w)
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	writeTarEntry(tw, archiveManifestName, manifest.Created, manifestBytes)
+
+	for _, item := range manifest.Items {
+		copyToTar(tw, item.stillName(), item.Captured, repo.canonDataPath(item.Camera, fmt.Sprintf("%s.jpg", item.Handle)))
+		for _, ext := range item.videoExts() {
+			copyToTar(tw, item.videoName(ext), item.Captured, repo.canonDataPath(item.Camera, fmt.Sprintf("%s.%s", item.Handle, ext)))
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		panic(err)
+	}
+
+	log.Status("RepositoryConfig.Export", fmt.Sprintf("exported %d images from %v", len(manifest.Items), cameras))
+	return len(manifest.Items)
+}
+
+func writeTarEntry(tw *tar.Writer, name string, modTime time.Time, content []byte) {
+	hdr := &tar.Header{Name: name, Mode: 0640, Size: int64(len(content)), ModTime: modTime}
+	if err := tw.WriteHeader(hdr); err != nil {
+		panic(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		panic(err)
+	}
+}
+
+func copyToTar(tw *tar.Writer, name string, modTime time.Time, file string) {
+	f, err := os.Open(file)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		panic(err)
+	}
+
+	hdr := &tar.Header{Name: name, Mode: 0640, Size: fi.Size(), ModTime: modTime}
+	if err := tw.WriteHeader(hdr); err != nil {
+		panic(err)
+	}
+	if _, err := io.Copy(tw, f); err != nil {
+		panic(err)
+	}
+}
+
+// Import reads an archive written by Export, storing and pinning its media in this repository. Cameras
+// in the archive that don't exist here are created from its manifest, without any way of capturing
+// from them (which has to be set up anew); ones that do exist are left as they are. Images already present are simply re-pinned, so importing is idempotent. Returns the
+// number of images imported.
+func (repo *RepositoryConfig) Import(r io.Reader) int {
+	TAG := "RepositoryConfig.Import"
+
+	tr := tar.NewReader(r)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		panic(err)
+	}
+	if hdr.Name != archiveManifestName {
+		panic(fmt.Errorf("archive begins with '%s' instead of a manifest", hdr.Name))
+	}
+	manifest := &ArchiveManifest{}
+	if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+		panic(err)
+	}
+	if manifest.Version != archiveVersion {
+		panic(fmt.Errorf("unsupported archive version %d", manifest.Version))
+	}
+
+	// check everything before storing anything, since camera IDs become directory names
+	known := make(map[string]*Camera)
+	for _, ac := range manifest.Cameras {
+		cam := ac.camera()
+		if err := cam.Validate(); err != nil {
+			panic(fmt.Errorf("archive contains invalid camera (%s)", err))
+		}
+		known[cam.ID] = cam
+	}
+
+	byName := make(map[string]*ArchiveItem)
+	for _, item := range manifest.Items {
+		if !handleRE.MatchString(item.Handle) || !cameraIDRE.MatchString(item.Camera) || !(known[item.Camera] != nil || System.GetCamera(item.Camera) != nil) {
+			panic(fmt.Errorf("archive contains invalid item '%s/%s'", item.Camera, item.Handle))
+		}
+		for _, kind := range item.Kinds {
+			if !kind.IsValid() {
+				panic(fmt.Errorf("archive item '%s' has invalid kind '%s'", item.Handle, kind))
+			}
+		}
+		for _, ext := range item.Renditions {
+			if ext == "jpg" || mediaTypes[ext] == "" {
+				panic(fmt.Errorf("archive item '%s' has invalid rendition '%s'", item.Handle, ext))
+			}
+		}
+		byName[item.stillName()] = item
+		for _, ext := range item.videoExts() {
+			byName[item.videoName(ext)] = item
+		}
+	}
+
+	for _, cam := range known {
+		if System.GetCamera(cam.ID) == nil {
+			log.Status(TAG, fmt.Sprintf("creating camera '%s' from archive", cam.ID))
+			cam.Store()
+		}
+	}
+
+	images := make(map[*ArchiveItem]*Image)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			panic(err)
+		}
+		item, ok := byName[hdr.Name]
+		if !ok {
+			log.Warn(TAG, fmt.Sprintf("skipping unexpected archive entry '%s'", hdr.Name))
+			continue
+		}
+		if hdr.Name == item.stillName() {
+			if hdr.Size > maxStillSize {
+				panic(fmt.Errorf("archive entry '%s' is too large (%d bytes)", hdr.Name, hdr.Size))
+			}
+			content, err := ioutil.ReadAll(tr)
+			if err != nil {
+				panic(err)
+			}
+			potato := sha256.Sum256(content)
+			if hash := hex.EncodeToString(potato[:]); hash != item.Handle {
+				panic(fmt.Errorf("archive entry '%s' is corrupt; contents hash to %s", hdr.Name, hash))
+			}
+			images[item] = storeImage(item.Camera, content, item.Captured)
+		} else {
+			img, ok := images[item]
+			if !ok {
+				panic(fmt.Errorf("archive entry '%s' precedes its still", hdr.Name))
+			}
+			// videos can be large, so stream them rather than reading them into memory
+			ext := strings.TrimPrefix(path.Ext(hdr.Name), ".")
+			if !img.HasRendition(ext) {
+				img.copyRendition(ext, tr)
+			}
+		}
+	}
+
+	// pin last, so that videos get pinned along with their stills
+	for _, item := range manifest.Items {
+		img, ok := images[item]
+		if !ok {
+			log.Warn(TAG, fmt.Sprintf("archive is missing '%s'", item.stillName()))
+			continue
+		}
+		for _, kind := range item.Kinds {
+			img.Pin(kind)
+		}
+	}
+
+	log.Status(TAG, fmt.Sprintf("imported %d images", len(images)))
+	return len(images)
+}
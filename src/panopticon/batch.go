@@ -0,0 +1,179 @@
+// Copyright © 2019 Dan Morrill
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panopticon
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"panopticon/messages"
+
+	"playground/httputil"
+	"playground/log"
+)
+
+/*
+ * Batch Uploads
+ *
+ * A camera that has been unable to reach the server can catch up by posting
+ * everything it has spooled to /camera/batch, as multipart/form-data with one
+ * part per image. Each part's form name is its kind ("collected" or "motion"),
+ * its file name is an identifier of the camera's choosing that's echoed back
+ * in the results, and its capture time goes in the part's Capture-Time header
+ * (messages.BatchCaptureTimeHeader) unless the image records it. That header
+ * is always honored, whatever SystemConfig.CaptureTimeHeader is set to; the
+ * latter is accepted too, for cameras that used it before.
+ *
+ * Each item is reported on separately:
+ *   - "stored" if it was stored and pinned
+ *   - "duplicate" if the same bytes were already received from this camera
+ *   - "dropped" if it was taken while the camera should have been asleep, or
+ *     so long ago that its retention period has passed
+ *   - "rejected" if it isn't an image, or otherwise can't ever be accepted
+ * Items are recognized by the hash of the bytes as sent, so a camera can
+ * safely resend a whole batch until every item is accounted for, and then
+ * discard everything except what was rejected. The server remembers what it
+ * has received for batchMemory.
+ */
+
+const (
+	BatchStored    = "stored"
+	BatchDuplicate = "duplicate"
+	BatchDropped   = "dropped"
+	BatchRejected  = "rejected"
+)
+
+// batchMemory is how long the hashes of batch items are remembered, i.e. how long a camera has to
+// finish retrying a batch.
+const batchMemory = 7 * 24 * time.Hour
+
+// BatchHandler handles /camera/batch
+func BatchHandler(writer http.ResponseWriter, req *http.Request) {
+	TAG := "panopticon.BatchHandler"
+	badReq := httputil.NewJSONAssertable(writer, TAG, http.StatusBadRequest, clientError)
+
+	cam := uploader(writer, req, TAG)
+	mr, err := req.MultipartReader()
+	badReq.Assert(err == nil, "malformed batch upload from '%s' (%s)", cam.ID, err)
+
+	System.writeDatabaseByQuery("delete from BatchUploads where Received < ?", time.Now().Add(-batchMemory).UTC())
+
+	captureHeader := System.Current().CaptureTimeHeader
+	res := &messages.BatchResult{Camera: cam.ID, Items: []*messages.BatchItem{}}
+	counts := map[string]int{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		badReq.Assert(err == nil, "malformed batch upload from '%s' (%s)", cam.ID, err)
+
+		// a part that can't be read in full is a transport problem rather than a problem with the item,
+		// so fail the whole request; the client will resend it
+		b, err := ioutil.ReadAll(io.LimitReader(part, maxStillSize+1))
+		badReq.Assert(err == nil, "error reading batch item '%s' (%s)", part.FileName(), err)
+
+		rawCaptured := part.Header.Get(messages.BatchCaptureTimeHeader)
+		if rawCaptured == "" && captureHeader != "" {
+			rawCaptured = part.Header.Get(captureHeader)
+		}
+		item := batchItem(cam, part.FormName(), rawCaptured, b)
+		item.ID = part.FileName()
+		res.Items = append(res.Items, item)
+		counts[item.Status]++
+	}
+
+	log.Status(TAG, fmt.Sprintf("batch of %d from '%s': %d stored, %d duplicate, %d dropped, %d rejected", len(res.Items),
+		cam.ID, counts[BatchStored], counts[BatchDuplicate], counts[BatchDropped], counts[BatchRejected]))
+
+	httputil.SendJSON(writer, http.StatusOK, &APIResponse{Artifact: res})
+}
+
+// batchItem processes one item of a batch upload.
+func batchItem(cam *Camera, kindstr string, rawCaptured string, b []byte) *messages.BatchItem {
+	potato := sha256.Sum256(b)
+	item := &messages.BatchItem{Hash: hex.EncodeToString(potato[:])}
+
+	if handle, ok := batchReceived(cam, item.Hash); ok {
+		item.Status = BatchDuplicate
+		item.Handle = handle
+		return item
+	}
+
+	reject := func(format string, args ...interface{}) *messages.BatchItem {
+		item.Status = BatchRejected
+		item.Error = fmt.Sprintf(format, args...)
+		return item
+	}
+
+	kind := Repository.segmentToMediaKind(kindstr)
+	if kind != MediaCollected && kind != MediaMotion {
+		return reject("unsupported kind '%s'", kindstr)
+	}
+	if len(b) > maxStillSize {
+		return reject("image exceeds %d bytes", maxStillSize)
+	}
+	var captured time.Time
+	if rawCaptured != "" {
+		var err error
+		if captured, err = parseCaptureTime(rawCaptured); err != nil {
+			return reject("unparseable capture time '%s'", rawCaptured)
+		}
+	}
+
+	img, err := ingest(cam, b, captured, kind)
+	if err != nil {
+		return reject("not an image (%s)", err)
+	}
+	if img == nil {
+		item.Status = BatchDropped
+	} else {
+		item.Status = BatchStored
+		item.Handle = img.Handle
+		item.Timestamp = img.PrettyTime()
+	}
+
+	System.writeDatabaseByQuery("insert or ignore into BatchUploads (Camera, Hash, Handle, Received) values (?, ?, ?, ?)",
+		cam.ID, item.Hash, item.Handle, time.Now().UTC())
+	return item
+}
+
+// batchReceived looks up whether a batch item with the indicated hash was already received from the
+// camera, and if so, the handle of the image it was stored as (which is empty if it was dropped.)
+func batchReceived(cam *Camera, hash string) (string, bool) {
+	cxn := System.getDB()
+	defer cxn.Close()
+
+	var handle string
+	err := cxn.QueryRow("select Handle from BatchUploads where Camera=? and Hash=?", cam.ID, hash).Scan(&handle)
+	if err == sql.ErrNoRows {
+		return "", false
+	}
+	if err != nil {
+		panic(err)
+	}
+	return handle, true
+}
+
+// clearBatches forgets which batch items were received from the camera, e.g. when it's deleted.
+func (c *Camera) clearBatches() {
+	System.writeDatabaseByQuery("delete from BatchUploads where Camera=?", c.ID)
+}
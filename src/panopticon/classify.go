@@ -0,0 +1,247 @@
+// Copyright © 2019 Dan Morrill
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panopticon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"panopticon/messages"
+
+	"playground/log"
+)
+
+/*
+ * Classification
+ *
+ * A Classifier labels images with what it recognizes in them (e.g. "person",
+ * "car") and how confident it is of each. If one is installed, every image that
+ * arrives from a camera is queued for it, and classified one at a time in the
+ * background; the labels are then stored alongside the image, shown in its
+ * metadata, and can be used to filter /client/images.
+ *
+ * The built-in CommandClassifier runs an external command for each image,
+ * which is how RepositoryConfig.ClassifierCommand is applied. The command gets
+ * a messages.ClassifyRequest as JSON on stdin (the image is base64-encoded, per
+ * encoding/json), and must write a messages.ClassifyResult as JSON to stdout,
+ * e.g. {"Labels": [{"Name": "person", "Confidence": 0.92}]}.
+ *
+ * Classification is best-effort. If the classifier falls behind, new images
+ * are skipped rather than queued indefinitely, and failures are just logged.
+ */
+
+const (
+	classifyBacklog        = 256 // how many images can wait to be classified
+	DefaultClassifyTimeout = time.Minute
+)
+
+// Classifier labels images; see above.
+type Classifier interface {
+	// Classify returns labels for the image, whose JPEG bytes are `b`.
+	Classify(img *Image, b []byte) ([]*messages.Label, error)
+}
+
+var classification = struct {
+	lock       sync.Mutex
+	classifier Classifier
+	queue      chan *Image
+	start      sync.Once
+}{queue: make(chan *Image, classifyBacklog)}
+
+// SetClassifier installs the classifier that new images are passed to, replacing any previous one.
+// A nil classifier turns classification off.
+func SetClassifier(c Classifier) {
+	classification.lock.Lock()
+	classification.classifier = c
+	classification.lock.Unlock()
+	classification.start.Do(func() { go classifyImages() })
+}
+
+func currentClassifier() Classifier {
+	classification.lock.Lock()
+	defer classification.lock.Unlock()
+	return classification.classifier
+}
+
+// classifyLater queues a newly-stored image for classification, if there's a classifier.
+func classifyLater(img *Image) {
+	if currentClassifier() == nil {
+		return
+	}
+	select {
+	case classification.queue <- img:
+	default:
+		log.Warn("classifyLater", fmt.Sprintf("classifier is behind; skipping '%s'", img.Handle))
+	}
+}
+
+// classifyImages classifies queued images, forever.
+func classifyImages() {
+	for img := range classification.queue {
+		classifyImage(img)
+	}
+}
+
+func classifyImage(img *Image) {
+	TAG := "classifyImage"
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error(TAG, fmt.Sprintf("panic classifying '%s'", img.Handle), r)
+		}
+	}()
+
+	c := currentClassifier()
+	if c == nil {
+		return
+	}
+	// the image may have been purged while it waited
+	if Repository.lookupImage(img.Handle, img.Source) == nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	img.Retrieve(&buf)
+	labels, err := c.Classify(img, buf.Bytes())
+	if err != nil {
+		log.Warn(TAG, fmt.Sprintf("failed to classify '%s'", img.Handle), err)
+		return
+	}
+	img.setLabels(labels)
+	log.Debug(TAG, fmt.Sprintf("'%s' has %d labels", img.Handle, len(labels)))
+}
+
+// setLabels replaces the image's labels.
+func (img *Image) setLabels(labels []*messages.Label) {
+	System.writeDatabaseByQuery("delete from ImageLabels where Handle=? and Camera=?", img.Handle, img.Source)
+	for _, l := range labels {
+		if l == nil || l.Name == "" {
+			continue
+		}
+		System.writeDatabaseByQuery(`insert into ImageLabels (Handle, Camera, Label, Confidence) values (?, ?, ?, ?)
+			on conflict (Handle, Camera, Label) do update set Confidence=max(Confidence, excluded.Confidence)`,
+			img.Handle, img.Source, strings.ToLower(l.Name), l.Confidence)
+	}
+}
+
+// Labels returns the labels the classifier gave the image, most confident first.
+func (img *Image) Labels() []*messages.Label {
+	return Repository.labelsFor(img.Source, []string{img.Handle})[img.Handle]
+}
+
+// labelsFor returns the labels of the indicated images from a camera, by handle.
+func (repo *RepositoryConfig) labelsFor(camera string, handles []string) map[string][]*messages.Label {
+	ret := map[string][]*messages.Label{}
+
+	cxn := System.getDB()
+	defer cxn.Close()
+
+	// stay well under SQLite's limit on query parameters
+	for len(handles) > 0 {
+		chunk := handles
+		if len(chunk) > 500 {
+			chunk = chunk[:500]
+		}
+		handles = handles[len(chunk):]
+
+		params := []interface{}{camera}
+		for _, h := range chunk {
+			params = append(params, h)
+		}
+		q := fmt.Sprintf("select Handle, Label, Confidence from ImageLabels where Camera=? and Handle in (%s) order by Confidence desc", placeholders(len(chunk)))
+		rows, err := cxn.Query(q, params...)
+		if err != nil {
+			panic(err)
+		}
+		for rows.Next() {
+			var handle string
+			l := &messages.Label{}
+			if err := rows.Scan(&handle, &l.Name, &l.Confidence); err != nil {
+				rows.Close()
+				panic(err)
+			}
+			ret[handle] = append(ret[handle], l)
+		}
+		rows.Close()
+	}
+	return ret
+}
+
+// labeled returns the handles of a camera's images that have the indicated label with at least the
+// indicated confidence.
+func (repo *RepositoryConfig) labeled(camera string, label string, confidence float64) map[string]bool {
+	cxn := System.getDB()
+	defer cxn.Close()
+
+	rows, err := cxn.Query("select Handle from ImageLabels where Camera=? and Label=? and Confidence >= ?", camera, strings.ToLower(label), confidence)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	ret := map[string]bool{}
+	for rows.Next() {
+		var handle string
+		if err := rows.Scan(&handle); err != nil {
+			panic(err)
+		}
+		ret[handle] = true
+	}
+	return ret
+}
+
+// CommandClassifier is a Classifier that runs an external command for each image; see above.
+type CommandClassifier struct {
+	Command []string
+	Timeout time.Duration // zero means DefaultClassifyTimeout
+}
+
+// Classify implements Classifier.
+func (cc *CommandClassifier) Classify(img *Image, b []byte) ([]*messages.Label, error) {
+	if len(cc.Command) == 0 {
+		return nil, fmt.Errorf("no classifier command")
+	}
+	timeout := cc.Timeout
+	if timeout <= 0 {
+		timeout = DefaultClassifyTimeout
+	}
+
+	in, err := json.Marshal(&messages.ClassifyRequest{Camera: img.Source, Handle: img.Handle, Timestamp: img.Timestamp, JPEG: b})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, cc.Command[0], cc.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(in)
+	stderr := &tailWriter{max: 4096}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s (%s)", err, stderr.lastLine())
+	}
+
+	res := &messages.ClassifyResult{}
+	if err := json.Unmarshal(out, res); err != nil {
+		return nil, fmt.Errorf("unparseable classifier output (%s)", err)
+	}
+	return res.Labels, nil
+}
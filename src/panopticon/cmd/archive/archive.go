@@ -0,0 +1,136 @@
+// Copyright © 2019 Dan Morrill
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command archive exports media from a Panopticon repository into a self-describing tar file, or
+// imports such a file into a repository.
+//
+//	archive -export saved.tar -cameras dachacam -kinds saved,generated -from 2019-06-01
+//	archive -import saved.tar
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"panopticon"
+
+	"playground/config"
+	"playground/log"
+)
+
+var (
+	exportPath = flag.String("export", "", "write an archive to this file")
+	importPath = flag.String("import", "", "read an archive from this file")
+	cameras    = flag.String("cameras", "", "comma-separated camera IDs to export; defaults to all")
+	kinds      = flag.String("kinds", "saved,generated", "comma-separated kinds of media to export")
+	from       = flag.String("from", "", "export only media captured on or after this date (YYYY-MM-DD)")
+	to         = flag.String("to", "", "export only media captured before this date (YYYY-MM-DD)")
+)
+
+var cfg = &struct {
+	Debug      bool
+	LogFile    string
+	System     *panopticon.SystemConfig
+	Repository *panopticon.RepositoryConfig
+}{
+	false,
+	"",
+	panopticon.System,
+	panopticon.Repository,
+}
+
+func initConfig() {
+	config.Load(cfg)
+	if !flag.Parsed() {
+		flag.Parse()
+	}
+	if cfg.LogFile != "" {
+		log.SetLogFile(cfg.LogFile)
+	}
+	if cfg.Debug || config.Debug {
+		log.SetLogLevel(log.LEVEL_DEBUG)
+	}
+	cfg.System.Ready()
+
+	// exporting only reads the repository, so it mustn't reindex it out from under a running server
+	if *importPath != "" {
+		cfg.Repository.Prepare()
+	} else {
+		cfg.Repository.PrepareReadOnly()
+	}
+}
+
+func parseDate(s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bad date '%s': %s\n", s, err)
+		os.Exit(2)
+	}
+	return t
+}
+
+func split(s string) []string {
+	ret := []string{}
+	for _, chunk := range strings.Split(s, ",") {
+		if chunk = strings.TrimSpace(chunk); chunk != "" {
+			ret = append(ret, chunk)
+		}
+	}
+	return ret
+}
+
+func main() {
+	initConfig()
+
+	if (*exportPath == "") == (*importPath == "") {
+		fmt.Fprintln(os.Stderr, "exactly one of -export or -import is required")
+		os.Exit(2)
+	}
+
+	if *importPath != "" {
+		f, err := os.Open(*importPath)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		fmt.Printf("imported %d images\n", panopticon.Repository.Import(f))
+		return
+	}
+
+	mediaKinds := []panopticon.MediaKind{}
+	for _, k := range split(*kinds) {
+		kind := panopticon.MediaKind(k)
+		if !kind.IsValid() {
+			fmt.Fprintf(os.Stderr, "unknown kind '%s'\n", k)
+			os.Exit(2)
+		}
+		mediaKinds = append(mediaKinds, kind)
+	}
+
+	f, err := os.Create(*exportPath)
+	if err != nil {
+		panic(err)
+	}
+	n := panopticon.Repository.Export(f, split(*cameras), mediaKinds, parseDate(*from), parseDate(*to))
+	if err := f.Close(); err != nil {
+		panic(err)
+	}
+	fmt.Printf("exported %d images to %s\n", n, *exportPath)
+}
@@ -0,0 +1,101 @@
+// Copyright © 2019 Dan Morrill
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command fsck checks a Panopticon repository for inconsistencies between its image tree and its
+// index, and optionally repairs them. By default it only reports; pass -repair to fix things.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"panopticon"
+
+	"playground/config"
+	"playground/log"
+)
+
+var repair = flag.Bool("repair", false, "repair inconsistencies instead of only reporting them")
+
+var cfg = &struct {
+	Debug      bool
+	LogFile    string
+	System     *panopticon.SystemConfig
+	Repository *panopticon.RepositoryConfig
+}{
+	false,
+	"",
+	panopticon.System,
+	panopticon.Repository,
+}
+
+func initConfig() {
+	config.Load(cfg)
+	if !flag.Parsed() {
+		flag.Parse()
+	}
+	if cfg.LogFile != "" {
+		log.SetLogFile(cfg.LogFile)
+	}
+	if cfg.Debug || config.Debug {
+		log.SetLogLevel(log.LEVEL_DEBUG)
+	}
+	cfg.System.Ready()
+
+	// the index is only rebuilt by Fsck itself, and only when repairing; otherwise a stale index
+	// would be silently fixed instead of reported
+	cfg.Repository.PrepareReadOnly()
+}
+
+func main() {
+	initConfig()
+
+	findings := panopticon.Repository.Fsck(*repair)
+
+	counts := make(map[panopticon.FsckProblem]int)
+	unrepaired := 0
+	for _, f := range findings {
+		status := "found"
+		if f.Repaired {
+			status = "repaired"
+		} else {
+			unrepaired++
+		}
+		if f.Detail != "" {
+			fmt.Printf("%s: %s: %s (%s)\n", status, f.Problem, f.Path, f.Detail)
+		} else {
+			fmt.Printf("%s: %s: %s\n", status, f.Problem, f.Path)
+		}
+		counts[f.Problem]++
+	}
+
+	problems := []string{}
+	for problem := range counts {
+		problems = append(problems, string(problem))
+	}
+	sort.Strings(problems)
+	fmt.Printf("\n%d problems found\n", len(findings))
+	for _, problem := range problems {
+		fmt.Printf("%8d %s\n", counts[panopticon.FsckProblem(problem)], problem)
+	}
+	if !*repair && len(findings) > 0 {
+		fmt.Println("\nrun again with -repair to fix these")
+	}
+
+	if unrepaired > 0 {
+		os.Exit(1)
+	}
+}
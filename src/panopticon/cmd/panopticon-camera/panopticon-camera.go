@@ -0,0 +1,541 @@
+// Copyright © 2019 Dan Morrill
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command panopticon-camera runs on a camera: it captures images and uploads them to a Panopticon
+// instance. Usage:
+//
+//	panopticon-camera -enroll PAYLOAD|@FILE
+//	panopticon-camera
+//
+// The first form enrolls the camera, using the JSON payload from its provisioning QR code (see
+// `panopticonctl camera enroll` or /client/provision), and saves the service URL and API key it
+// receives to the Camera.EnrollmentPath file. The second form captures images forever.
+//
+// The server also says how the camera should capture -- its mode, interval, and motion sensitivity,
+// per the camera's CaptureMode, StillInterval, and MotionSensitivity -- and these are saved along with
+// the key. Each can be overridden in the local config file (the same one as EnrollmentPath), which is
+// also where the device and the like are configured. Since the server's settings are only delivered on
+// enrollment, re-enroll the camera to pick up changes to them.
+//
+// Images come from a V4L2 device (via v4l2-ctl), or from any command that writes a single JPEG to
+// stdout, such as `libcamera-still -o -`. In "collected" mode every image is uploaded; in "motion"
+// mode only those that differ enough from the one before are, as motion images.
+//
+// Captured images are spooled to disk, and uploaded from there in batches (see /camera/batch), so
+// nothing is lost while the server is unreachable; uploads are retried with backoff until the server
+// has accounted for every image. If the spool fills up, the oldest collected images are discarded
+// first.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"panopticon/messages"
+
+	"playground/config"
+	"playground/log"
+)
+
+type cameraConfig struct {
+	EnrollmentPath  string   // where the camera's ID, key, and service URL are kept once enrolled
+	SpoolDirectory  string   // where images wait to be uploaded
+	SpoolLimit      int      // most images to keep spooled
+	Device          string   // V4L2 device to capture from, unless CaptureCommand is set
+	Width           int      // V4L2 capture size
+	Height          int      //
+	CaptureCommand  []string // command that writes one JPEG to stdout
+	ResetCommand    []string // command to run after repeated capture failures, e.g. to power-cycle a USB camera
+	Mode            string   // "collected" or "motion"; empty for the server's choice
+	Interval        int      // seconds between captures; zero for the server's choice
+	MotionThreshold float64  // mean change per pixel (0-255) between images that counts as motion; zero for the server's choice
+	BatchSize       int      // most images to upload per request
+	Timeout         int      // seconds allowed for each upload request
+}
+
+var cfg = &struct {
+	Debug   bool
+	LogFile string
+	Camera  *cameraConfig
+}{
+	false,
+	"",
+	&cameraConfig{
+		"./enrollment.json", "./spool", 10000, "/dev/video0", 1920, 1080, nil, nil,
+		"", 0, 0, 50, 60,
+	},
+}
+
+var enroll = flag.String("enroll", "", "enroll using this provisioning payload (or @FILE containing it), then exit")
+
+const (
+	captureFailureLimit = 3 // consecutive failures after which ResetCommand is run
+	minBackoff          = time.Second
+	maxBackoff          = 5 * time.Minute
+	spoolExt            = ".jpg"
+	motionThumbWidth    = 64
+	motionThumbHeight   = 36
+
+	// what to capture if neither the local config nor the server says
+	defaultMode            = "collected"
+	defaultInterval        = 5
+	defaultMotionThreshold = 8
+)
+
+func initConfig() {
+	config.Load(cfg)
+	if !flag.Parsed() {
+		flag.Parse()
+	}
+	if cfg.LogFile != "" {
+		log.SetLogFile(cfg.LogFile)
+	}
+	if cfg.Debug || config.Debug {
+		log.SetLogLevel(log.LEVEL_DEBUG)
+	}
+}
+
+func main() {
+	TAG := "panopticon-camera"
+	initConfig()
+
+	c := cfg.Camera
+	if *enroll != "" {
+		if err := doEnroll(*enroll, c.EnrollmentPath); err != nil {
+			fmt.Fprintf(os.Stderr, "panopticon-camera: enrollment failed: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	enrollment, err := loadEnrollment(c.EnrollmentPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "panopticon-camera: not enrolled (%s); run with -enroll first\n", err)
+		os.Exit(1)
+	}
+	applyEnrollment(c, enrollment)
+	if c.Mode != "collected" && c.Mode != "motion" {
+		fmt.Fprintf(os.Stderr, "panopticon-camera: unknown mode '%s'\n", c.Mode)
+		os.Exit(1)
+	}
+	if err := os.MkdirAll(c.SpoolDirectory, 0700); err != nil {
+		fmt.Fprintf(os.Stderr, "panopticon-camera: %s\n", err)
+		os.Exit(1)
+	}
+
+	log.Status(TAG, fmt.Sprintf("camera '%s' capturing %s images every %ds for %s", enrollment.Camera, c.Mode, c.Interval, enrollment.ServiceURL))
+	spooled := make(chan struct{}, 1)
+	go upload(enrollment, spooled)
+	capture(spooled)
+}
+
+// doEnroll exchanges the enrollment token in a provisioning payload for the camera's API key, and
+// saves the result to `path`.
+func doEnroll(payload string, path string) error {
+	TAG := "doEnroll"
+
+	if strings.HasPrefix(payload, "@") {
+		b, err := ioutil.ReadFile(payload[1:])
+		if err != nil {
+			return err
+		}
+		payload = string(b)
+	}
+	provisioning := &messages.Enrollment{}
+	if err := json.Unmarshal([]byte(payload), provisioning); err != nil {
+		return fmt.Errorf("unparseable payload (%s)", err)
+	}
+	if provisioning.ServiceURL == "" || provisioning.Token == "" {
+		return fmt.Errorf("payload lacks service URL or token")
+	}
+
+	body, err := json.Marshal(&messages.Enrollment{Token: provisioning.Token})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: time.Duration(cfg.Camera.Timeout) * time.Second}
+	res, err := client.Post(serviceURL(provisioning.ServiceURL, "/camera/enroll"), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	result := &messages.EnrollmentResult{}
+	if err := decodeResponse(res, result); err != nil {
+		return err
+	}
+	if result.ServiceURL == "" {
+		result.ServiceURL = provisioning.ServiceURL
+	}
+
+	b, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		return err
+	}
+	log.Status(TAG, fmt.Sprintf("enrolled as '%s' (%s) with %s", result.Camera, result.Name, result.ServiceURL))
+	return nil
+}
+
+func loadEnrollment(path string) (*messages.EnrollmentResult, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	enrollment := &messages.EnrollmentResult{}
+	if err := json.Unmarshal(b, enrollment); err != nil {
+		return nil, err
+	}
+	if enrollment.ServiceURL == "" || enrollment.Key == "" {
+		return nil, fmt.Errorf("'%s' lacks service URL or key", path)
+	}
+	return enrollment, nil
+}
+
+// applyEnrollment fills in whatever capture settings the local config leaves unset from those the
+// server delivered on enrollment, or failing that, from the defaults.
+func applyEnrollment(c *cameraConfig, enrollment *messages.EnrollmentResult) {
+	if c.Mode == "" {
+		c.Mode = enrollment.CaptureMode
+	}
+	if c.Mode == "" {
+		c.Mode = defaultMode
+	}
+	if c.Interval <= 0 {
+		c.Interval = enrollment.CaptureInterval
+	}
+	if c.Interval <= 0 {
+		c.Interval = defaultInterval
+	}
+	if c.MotionThreshold <= 0 && enrollment.MotionSensitivity > 0 {
+		c.MotionThreshold = sensitivityThreshold(enrollment.MotionSensitivity)
+	}
+	if c.MotionThreshold <= 0 {
+		c.MotionThreshold = defaultMotionThreshold
+	}
+}
+
+// sensitivityThreshold converts a motion sensitivity from 1 (least sensitive) to 100 (most) into a
+// MotionThreshold, from 20 down to 0.2; the default threshold is a sensitivity of about 60.
+func sensitivityThreshold(sensitivity int) float64 {
+	return float64(101-sensitivity) / 5
+}
+
+func serviceURL(base string, path string) string {
+	return strings.TrimSuffix(base, "/") + path
+}
+
+// decodeResponse unpacks the artifact of a successful API response into `artifact`, or returns the
+// error the server reported.
+func decodeResponse(res *http.Response, artifact interface{}) error {
+	envelope := &struct {
+		Error    *struct{ Message, Extra string }
+		Artifact interface{}
+	}{Artifact: artifact}
+	err := json.NewDecoder(res.Body).Decode(envelope)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		if err == nil && envelope.Error != nil {
+			return fmt.Errorf("%s: %s", res.Status, envelope.Error.Message)
+		}
+		return fmt.Errorf("%s", res.Status)
+	}
+	if err != nil {
+		return fmt.Errorf("unparseable response (%s)", err)
+	}
+	return nil
+}
+
+// capture takes an image every Interval, and spools those that should be uploaded, poking `spooled`
+// whenever it does.
+func capture(spooled chan struct{}) {
+	TAG := "capture"
+	c := cfg.Camera
+
+	var previous []uint8
+	failures := 0
+	for {
+		start := time.Now()
+		b, err := captureImage()
+		if err != nil {
+			failures++
+			log.Warn(TAG, fmt.Sprintf("capture failed (%d in a row)", failures), err)
+			if failures >= captureFailureLimit && len(c.ResetCommand) > 0 {
+				log.Status(TAG, "resetting camera")
+				if out, err := exec.Command(c.ResetCommand[0], c.ResetCommand[1:]...).CombinedOutput(); err != nil {
+					log.Error(TAG, "reset failed", err, string(out))
+				}
+				failures = 0
+			}
+		} else {
+			failures = 0
+			kind := c.Mode
+			if c.Mode == "motion" {
+				var moved bool
+				previous, moved = detectMotion(previous, b)
+				if !moved {
+					kind = ""
+				}
+			}
+			if kind != "" {
+				if err := spool(b, kind, start); err != nil {
+					log.Error(TAG, "failed to spool image", err)
+				} else {
+					select {
+					case spooled <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+
+		if d := time.Duration(c.Interval)*time.Second - time.Since(start); d > 0 {
+			time.Sleep(d)
+		}
+	}
+}
+
+// captureImage runs the capture command, or v4l2-ctl, and returns the JPEG it produces.
+func captureImage() ([]byte, error) {
+	c := cfg.Camera
+	args := c.CaptureCommand
+	if len(args) == 0 {
+		args = []string{
+			"v4l2-ctl", "--device", c.Device,
+			fmt.Sprintf("--set-fmt-video=width=%d,height=%d,pixelformat=MJPG", c.Width, c.Height),
+			"--stream-mmap=3", "--stream-count=1", "--stream-to=-",
+		}
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+	if len(b) < 2 || b[0] != 0xFF || b[1] != 0xD8 {
+		return nil, fmt.Errorf("capture produced %d bytes that aren't a JPEG", len(b))
+	}
+	return b, nil
+}
+
+// detectMotion compares an image with the thumbnail of the previous one, and reports whether they
+// differ by more than the MotionThreshold. Returns the image's own thumbnail for next time. The first
+// image never counts as motion.
+func detectMotion(previous []uint8, b []byte) ([]uint8, bool) {
+	img, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		log.Warn("detectMotion", "undecodable image", err)
+		return previous, false
+	}
+	thumb := grayThumbnail(img)
+	if len(previous) != len(thumb) {
+		return thumb, false
+	}
+	var total float64
+	for i := range thumb {
+		total += math.Abs(float64(thumb[i]) - float64(previous[i]))
+	}
+	return thumb, total/float64(len(thumb)) > cfg.Camera.MotionThreshold
+}
+
+// grayThumbnail samples an image down to a small grayscale one, which is plenty for noticing motion.
+func grayThumbnail(img image.Image) []uint8 {
+	bounds := img.Bounds()
+	thumb := make([]uint8, 0, motionThumbWidth*motionThumbHeight)
+	for y := 0; y < motionThumbHeight; y++ {
+		for x := 0; x < motionThumbWidth; x++ {
+			px := bounds.Min.X + (2*x+1)*bounds.Dx()/(2*motionThumbWidth)
+			py := bounds.Min.Y + (2*y+1)*bounds.Dy()/(2*motionThumbHeight)
+			r, g, b, _ := img.At(px, py).RGBA()
+			thumb = append(thumb, uint8((299*r+587*g+114*b)/1000>>8))
+		}
+	}
+	return thumb
+}
+
+// spool writes an image to the spool directory, named for its capture time and kind, e.g.
+// "1570000000123456789.motion.jpg", and discards the oldest images if that makes too many.
+func spool(b []byte, kind string, captured time.Time) error {
+	dir := cfg.Camera.SpoolDirectory
+	name := fmt.Sprintf("%d.%s%s", captured.UnixNano(), kind, spoolExt)
+
+	// write under a name the uploader ignores, so that it never sees a partial file
+	tmp := filepath.Join(dir, "."+name)
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		return err
+	}
+
+	names, err := spooledImages()
+	if err != nil {
+		return err
+	}
+	excess := len(names) - cfg.Camera.SpoolLimit
+	if excess <= 0 {
+		return nil
+	}
+	log.Warn("spool", fmt.Sprintf("spool is full; discarding %d oldest images", excess))
+	for _, preferCollected := range []bool{true, false} {
+		for _, name := range names {
+			if excess > 0 && (!preferCollected || strings.Contains(name, ".collected.")) {
+				if err := os.Remove(filepath.Join(dir, name)); err == nil {
+					excess--
+				}
+			}
+		}
+		names, _ = spooledImages()
+	}
+	return nil
+}
+
+// spooledImages lists the images waiting in the spool, oldest first.
+func spooledImages() ([]string, error) {
+	entries, err := ioutil.ReadDir(cfg.Camera.SpoolDirectory)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") && strings.HasSuffix(entry.Name(), spoolExt) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names) // fixed-width nanosecond timestamps, so lexical order is chronological
+	return names, nil
+}
+
+// upload sends spooled images to the server, oldest first, forever. It waits for `spooled` when
+// there's nothing to send, and backs off while the server can't be reached.
+func upload(enrollment *messages.EnrollmentResult, spooled chan struct{}) {
+	TAG := "upload"
+	c := cfg.Camera
+	client := &http.Client{Timeout: time.Duration(c.Timeout) * time.Second}
+
+	backoff := minBackoff
+	for {
+		names, err := spooledImages()
+		if err != nil {
+			log.Error(TAG, "unable to read spool", err)
+		}
+		if len(names) == 0 {
+			<-spooled
+			continue
+		}
+		if len(names) > c.BatchSize {
+			names = names[:c.BatchSize]
+		}
+
+		if err := uploadBatch(client, enrollment, names); err != nil {
+			log.Warn(TAG, fmt.Sprintf("upload of %d images failed; retrying in %s", len(names), backoff), err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = minBackoff
+	}
+}
+
+// uploadBatch posts the named spooled images to /camera/batch, and removes those the server
+// accounted for.
+func uploadBatch(client *http.Client, enrollment *messages.EnrollmentResult, names []string) error {
+	TAG := "uploadBatch"
+	dir := cfg.Camera.SpoolDirectory
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, name := range names {
+		chunks := strings.Split(name, ".")
+		nanos, err := strconv.ParseInt(chunks[0], 10, 64)
+		if len(chunks) != 3 || err != nil {
+			log.Warn(TAG, fmt.Sprintf("discarding unrecognized spool file '%s'", name))
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, chunks[1], name))
+		header.Set("Content-Type", "image/jpeg")
+		header.Set(messages.BatchCaptureTimeHeader, time.Unix(0, nanos).UTC().Format(time.RFC3339Nano))
+		part, err := mw.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		if _, err := part.Write(b); err != nil {
+			return err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", serviceURL(enrollment.ServiceURL, "/camera/batch"), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+enrollment.Key)
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	result := &messages.BatchResult{}
+	if err := decodeResponse(res, result); err != nil {
+		return err
+	}
+
+	// every status is final, so whatever the server reported on is done with
+	for _, item := range result.Items {
+		if item.Status == "rejected" {
+			log.Warn(TAG, fmt.Sprintf("server rejected '%s': %s", item.ID, item.Error))
+		}
+		if filepath.Base(item.ID) != item.ID {
+			continue // not one of ours
+		}
+		if err := os.Remove(filepath.Join(dir, item.ID)); err != nil && !os.IsNotExist(err) {
+			log.Warn(TAG, "failed to remove uploaded image", err)
+		}
+	}
+	log.Debug(TAG, fmt.Sprintf("uploaded %d images", len(result.Items)))
+	return nil
+}
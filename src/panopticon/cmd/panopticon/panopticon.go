@@ -27,14 +27,13 @@ import (
 )
 
 type serverConfig struct {
-	Hostname        string
-	BindAddress     string
-	Port            int
-	HTTPPort        int
-	TLSKeypairs     [][]string
-	StaticPath      string
-	PreloadList     []string
-	CameraAPISecret *struct{ Header, Value string }
+	Hostname    string
+	BindAddress string
+	Port        int
+	HTTPPort    int
+	TLSKeypairs [][]string
+	StaticPath  string
+	PreloadList []string
 }
 
 var cfg = &struct {
@@ -53,7 +52,6 @@ var cfg = &struct {
 			"index.html", "panopticon.css", "panopticon.js", "favicon.ico",
 			"no-image.png", "manifest.json", "icon-192.png", "icon-512.png",
 		},
-		&struct{ Header, Value string }{},
 	},
 	panopticon.System,
 	panopticon.Repository,
@@ -86,9 +84,6 @@ func main() {
 
 	w := httputil.Wrapper().WithPanicHandler().WithMethodSentry("GET")
 
-	// Single API endpoint for provisioning QR
-	mux.HandleFunc("/client/provision", w.Wrap(panopticon.ProvisionHandler))
-
 	// OAuth2 session login handler
 	mux.HandleFunc(session.Config.OAuth.RedirectPath, w.Wrap(static.OAuthHandler))
 
@@ -106,12 +101,29 @@ func main() {
 	mux.HandleFunc("/client/video/", w.WithMethodSentry("GET").Wrap(panopticon.ImageHandler))
 	mux.HandleFunc("/client/imagemeta/", w.WithMethodSentry("GET").Wrap(panopticon.ImageMetaHandler))
 	mux.HandleFunc("/client/images/", w.WithMethodSentry("GET").Wrap(panopticon.ImageListHandler))
+	// note the trailing slash: /client/events is the stream of server-sent events, while
+	// /client/events/<camera> lists a camera's motion events
+	mux.HandleFunc("/client/events", w.WithMethodSentry("GET").Wrap(panopticon.EventsHandler))
+	mux.HandleFunc("/client/events/", w.WithMethodSentry("GET", "PUT").Wrap(panopticon.MotionEventsHandler))
+	mux.HandleFunc("/client/uptime/", w.WithMethodSentry("GET").Wrap(panopticon.UptimeHandler))
+	mux.HandleFunc("/client/live/", w.WithMethodSentry("GET").Wrap(panopticon.LiveHandler))
 	mux.HandleFunc("/client/save/", w.WithMethodSentry("PUT").Wrap(panopticon.SaveHandler))
+	mux.HandleFunc("/client/provision/", w.WithMethodSentry("GET").Wrap(panopticon.ProvisionHandler))
+
+	// API endpoints for administration; these accept several methods, and the handlers further
+	// restrict them to privileged users
+	w = httputil.Wrapper().WithPanicHandler().WithSessionSentry(panopticon.AuthError).WithAuthCallback(panopticon.AuthError, emailInspector)
+	mux.HandleFunc("/api/config", w.Wrap(panopticon.ConfigHandler))
+	mux.HandleFunc("/api/cameras/", w.Wrap(panopticon.CameraConfigHandler))
+	mux.HandleFunc("/api/users/", w.Wrap(panopticon.UserConfigHandler))
 
-	// API endpoints for camera clients
-	w = httputil.Wrapper().WithPanicHandler().WithSecretSentry(cfg.Server.CameraAPISecret.Header, cfg.Server.CameraAPISecret.Value)
+	// API endpoints for camera clients; each camera authenticates with its own key (see keys.go),
+	// except when enrolling, for which it uses a one-time token instead (see enroll.go)
+	w = httputil.Wrapper().WithPanicHandler()
 	mux.HandleFunc("/camera/motion", w.WithMethodSentry("POST").Wrap(panopticon.MotionHandler))
 	mux.HandleFunc("/camera/latest", w.WithMethodSentry("POST").Wrap(panopticon.LatestHandler))
+	mux.HandleFunc("/camera/batch", w.WithMethodSentry("POST").Wrap(panopticon.BatchHandler))
+	mux.HandleFunc("/camera/enroll", w.WithMethodSentry("POST").Wrap(panopticon.EnrollHandler))
 
 	// start up an HSTS redirector to our TLS port
 	httputil.Config.EnableHSTS = true
@@ -0,0 +1,467 @@
+// Copyright © 2019 Dan Morrill
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command panopticonctl administers the cameras, users, and settings of a Panopticon instance, using
+// the same config file as the server. Usage:
+//
+//	panopticonctl [-json] camera list
+//	panopticonctl [-json] camera add [flags] ID
+//	panopticonctl [-json] camera edit [flags] ID
+//	panopticonctl camera rm ID
+//	panopticonctl camera key [-grace 24h] ID
+//	panopticonctl [-json] camera keys ID
+//	panopticonctl camera revoke ID [PREFIX]
+//	panopticonctl camera enroll [-ttl 1h] [-qr FILE.png] ID
+//	panopticonctl [-json] camera status ID
+//	panopticonctl [-json] camera zones ID
+//	panopticonctl camera zone [-inactive] ID NAME include|exclude X,Y X,Y X,Y...
+//	panopticonctl camera unzone ID [NAME]
+//	panopticonctl [-json] user list
+//	panopticonctl [-json] user add [-privileged] EMAIL NAME
+//	panopticonctl user grant|revoke|rm EMAIL
+//	panopticonctl [-json] setting get [KEY]
+//	panopticonctl setting set KEY VALUE
+//
+// `camera add` and `camera edit` accept the same flags; run either with -h to list them. Edits change
+// only the fields whose flags are given. `camera key` issues a new upload key for a camera and prints
+// it; this is the only time the key is shown. Its old keys stop working after the grace period.
+// `camera enroll` instead creates a one-time token the camera can exchange for a key itself, and
+// prints it, optionally also writing it as a QR code for the camera to scan. `camera status` shows
+// how the server's own attempts to capture from the camera (e.g. polling its still URL) are going.
+// `camera zone` adds or replaces a motion zone, whose points are fractions of the image's width and
+// height from its top left; `camera unzone` removes one, or all of them. `setting set` only stores the
+// new value; a running server reads settings when it starts, so restart it for the change to apply.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"panopticon"
+
+	"playground/config"
+	"playground/log"
+)
+
+var asJSON = flag.Bool("json", false, "print results as JSON instead of a table")
+
+var cfg = &struct {
+	Debug   bool
+	LogFile string
+	System  *panopticon.SystemConfig
+}{
+	false,
+	"",
+	panopticon.System,
+}
+
+func initConfig() {
+	config.Load(cfg)
+	if !flag.Parsed() {
+		flag.Parse()
+	}
+	if cfg.LogFile != "" {
+		log.SetLogFile(cfg.LogFile)
+	}
+	if cfg.Debug || config.Debug {
+		log.SetLogLevel(log.LEVEL_DEBUG)
+	}
+	cfg.System.Ready()
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: panopticonctl [-json] camera list|add|edit|rm|key|keys|revoke|enroll|status|zones|zone|unzone ...")
+	fmt.Fprintln(os.Stderr, "       panopticonctl [-json] user list|add|grant|revoke|rm ...")
+	fmt.Fprintln(os.Stderr, "       panopticonctl [-json] setting get|set ... (set takes effect when the server restarts)")
+	os.Exit(2)
+}
+
+// fail reports an error and exits; it's for problems with what was asked for, as opposed to usage.
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "panopticonctl: %s\n", fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+func main() {
+	initConfig()
+
+	args := flag.Args()
+	if len(args) < 2 {
+		usage()
+	}
+	switch args[0] {
+	case "camera":
+		cameraCmd(args[1], args[2:])
+	case "user":
+		userCmd(args[1], args[2:])
+	case "setting":
+		settingCmd(args[1], args[2:])
+	default:
+		usage()
+	}
+}
+
+func cameraCmd(verb string, args []string) {
+	switch verb {
+	case "list":
+		printCameras(panopticon.System.Cameras())
+
+	case "add", "edit":
+		fs := flag.NewFlagSet("camera "+verb, flag.ExitOnError)
+		cam := &panopticon.Camera{AspectRatio: string(panopticon.Aspect16x9), Timelapse: "none", Private: true}
+		if verb == "edit" {
+			// flags default to the current values, so that only the ones given change anything
+			if len(args) < 1 {
+				usage()
+			}
+			cam = mustCamera(args[len(args)-1])
+		}
+		cameraFlags(fs, cam)
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			usage()
+		}
+		if verb == "edit" && fs.Arg(0) != cam.ID {
+			usage() // flags after the ID
+		}
+		if verb == "add" {
+			if panopticon.System.GetCamera(fs.Arg(0)) != nil {
+				fail("camera '%s' already exists", fs.Arg(0))
+			}
+			cam.ID = fs.Arg(0)
+		}
+		if err := cam.Validate(); err != nil {
+			fail("%s", err)
+		}
+		cam.Store()
+		printCameras([]*panopticon.Camera{cam})
+
+	case "rm":
+		if len(args) != 1 {
+			usage()
+		}
+		mustCamera(args[0]).Delete()
+
+	case "key":
+		fs := flag.NewFlagSet("camera key", flag.ExitOnError)
+		grace := fs.String("grace", "", "how long the camera's old keys keep working, e.g. 24h (default: revoke immediately)")
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			usage()
+		}
+		var gracePeriod time.Duration
+		if *grace != "" {
+			var err error
+			if gracePeriod, err = panopticon.ParseRetention(*grace); err != nil {
+				fail("%s", err)
+			}
+		}
+		fmt.Println(mustCamera(fs.Arg(0)).RotateKey(gracePeriod))
+
+	case "keys":
+		if len(args) != 1 {
+			usage()
+		}
+		keys := mustCamera(args[0]).Keys()
+		if *asJSON {
+			printJSON(keys)
+			return
+		}
+		for _, k := range keys {
+			fmt.Println(k)
+		}
+
+	case "revoke":
+		if len(args) < 1 || len(args) > 2 {
+			usage()
+		}
+		cam := mustCamera(args[0])
+		if len(args) == 1 {
+			cam.RevokeKeys()
+		} else if !cam.RevokeKey(args[1]) {
+			fail("camera '%s' has no key '%s'", cam.ID, args[1])
+		}
+
+	case "enroll":
+		fs := flag.NewFlagSet("camera enroll", flag.ExitOnError)
+		ttl := fs.String("ttl", "", "how long the token is good for, e.g. 1h or 1d (default 1h)")
+		qrFile := fs.String("qr", "", "also write the token as a QR code to this PNG file")
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			usage()
+		}
+		lifetime := panopticon.DefaultEnrollmentTTL
+		if *ttl != "" {
+			var err error
+			if lifetime, err = panopticon.ParseRetention(*ttl); err != nil {
+				fail("%s", err)
+			}
+			if lifetime <= 0 {
+				fail("-ttl must be positive")
+			}
+		}
+		token, expires := mustCamera(fs.Arg(0)).EnrollmentToken(lifetime)
+		if *qrFile != "" {
+			var buf bytes.Buffer
+			panopticon.System.QR(&buf, token)
+			if err := ioutil.WriteFile(*qrFile, buf.Bytes(), 0600); err != nil {
+				fail("%s", err)
+			}
+		}
+		fmt.Printf("%s (expires %s)\n", token, expires.Format(time.RFC3339))
+
+	case "status":
+		if len(args) != 1 {
+			usage()
+		}
+		statuses := mustCamera(args[0]).CaptureStatus()
+		if *asJSON {
+			printJSON(statuses)
+			return
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "SOURCE\tLAST ATTEMPT\tLAST SUCCESS\tFAILURES\tERROR")
+		for _, s := range statuses {
+			success := "never"
+			if !s.LastSuccess.IsZero() {
+				success = s.LastSuccess.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", s.Source, s.LastAttempt.Format(time.RFC3339), success, s.Failures, s.LastError)
+		}
+		tw.Flush()
+
+	case "zones":
+		if len(args) != 1 {
+			usage()
+		}
+		zones := mustCamera(args[0]).MotionZones()
+		if *asJSON {
+			printJSON(zones)
+			return
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tMODE\tACTIVE\tPOINTS")
+		for _, z := range zones {
+			points := []string{}
+			for _, p := range z.Points {
+				points = append(points, fmt.Sprintf("%g,%g", p[0], p[1]))
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%t\t%s\n", z.Name, z.Mode, z.Active, strings.Join(points, " "))
+		}
+		tw.Flush()
+
+	case "zone":
+		fs := flag.NewFlagSet("camera zone", flag.ExitOnError)
+		inactive := fs.Bool("inactive", false, "store the zone, but don't apply it yet")
+		fs.Parse(args)
+		if fs.NArg() < 3 {
+			usage()
+		}
+		cam := mustCamera(fs.Arg(0))
+		z := &panopticon.MotionZone{Name: fs.Arg(1), Mode: fs.Arg(2), Active: !*inactive}
+		for _, raw := range fs.Args()[3:] {
+			var x, y float64
+			if _, err := fmt.Sscanf(raw, "%g,%g", &x, &y); err != nil {
+				fail("bad point '%s' (%s)", raw, err)
+			}
+			z.Points = append(z.Points, [2]float64{x, y})
+		}
+		if err := z.Validate(); err != nil {
+			fail("%s", err)
+		}
+		cam.StoreMotionZone(z)
+
+	case "unzone":
+		if len(args) < 1 || len(args) > 2 {
+			usage()
+		}
+		cam := mustCamera(args[0])
+		if len(args) == 1 {
+			cam.ClearMotionZones()
+		} else if !cam.DeleteMotionZone(args[1]) {
+			fail("camera '%s' has no zone '%s'", cam.ID, args[1])
+		}
+
+	default:
+		usage()
+	}
+}
+
+func mustCamera(id string) *panopticon.Camera {
+	cam := panopticon.System.GetCamera(id)
+	if cam == nil {
+		fail("no such camera '%s'", id)
+	}
+	return cam
+}
+
+func cameraFlags(fs *flag.FlagSet, cam *panopticon.Camera) {
+	fs.StringVar(&cam.Name, "name", cam.Name, "name shown in the UI")
+	fs.StringVar(&cam.AspectRatio, "aspect", cam.AspectRatio, "aspect ratio of images: 16x9 or 4x3")
+	fs.StringVar(&cam.Address, "address", cam.Address, "network address of the camera")
+	fs.BoolVar(&cam.Diurnal, "diurnal", cam.Diurnal, "ignore uploads between sunset and sunrise")
+	fs.BoolVar(&cam.Dewarp, "dewarp", cam.Dewarp, "correct fisheye distortion in uploads")
+	fs.BoolVar(&cam.Private, "private", cam.Private, "show only to privileged users")
+	fs.Float64Var(&cam.Latitude, "lat", cam.Latitude, "latitude of the camera")
+	fs.Float64Var(&cam.Longitude, "long", cam.Longitude, "longitude of the camera")
+	fs.StringVar(&cam.StillURL, "still", cam.StillURL, "URL from which a still image can be fetched")
+	fs.IntVar(&cam.StillInterval, "still-interval", cam.StillInterval, "seconds between fetches from the still URL, or between a camera client's captures (0 to never fetch)")
+	fs.StringVar(&cam.RTSPURL, "rtsp", cam.RTSPURL, "URL of the camera's RTSP stream")
+	fs.IntVar(&cam.FrameInterval, "frame-interval", cam.FrameInterval, "seconds between stills extracted from the RTSP stream (0 for none)")
+	fs.IntVar(&cam.SegmentLength, "segment-length", cam.SegmentLength, "length in seconds of video segments recorded from the RTSP stream (0 to not record)")
+	fs.IntVar(&cam.MotionSensitivity, "motion-sensitivity", cam.MotionSensitivity, "how readily collected images count as motion, 1-100 (0 to not analyze them)")
+	fs.StringVar(&cam.RetainCollected, "retain-collected", cam.RetainCollected, "retention period for collected images, e.g. 48h (empty for the default)")
+	fs.StringVar(&cam.RetainMotion, "retain-motion", cam.RetainMotion, "retention period for motion images (empty for the default)")
+	fs.StringVar(&cam.RetainGenerated, "retain-generated", cam.RetainGenerated, "retention period for timelapses, e.g. 14d (empty for the default)")
+	fs.StringVar(&cam.RetainRecorded, "retain-recorded", cam.RetainRecorded, "retention period for recorded video segments (empty for the default)")
+	fs.Var((*mediaKindValue)(&cam.CaptureMode), "capture-mode", "what a camera client uploads: collected or motion (empty for the client's choice)")
+	fs.Var((*mediaKindValue)(&cam.Timelapse), "timelapse", "images from which to generate timelapses: none, collected, motion, or both")
+}
+
+// mediaKindValue adapts a MediaKind to flag.Value.
+type mediaKindValue panopticon.MediaKind
+
+func (v *mediaKindValue) String() string     { return string(*v) }
+func (v *mediaKindValue) Set(s string) error { *v = mediaKindValue(s); return nil }
+
+func printCameras(cams []*panopticon.Camera) {
+	if *asJSON {
+		printJSON(cams)
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tASPECT\tTIMELAPSE\tDIURNAL\tPRIVATE\tLAT\tLONG")
+	for _, c := range cams {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%t\t%t\t%.4f\t%.4f\n", c.ID, c.Name, c.AspectRatio, c.Timelapse, c.Diurnal, c.Private, c.Latitude, c.Longitude)
+	}
+	tw.Flush()
+}
+
+func userCmd(verb string, args []string) {
+	switch verb {
+	case "list":
+		printUsers(panopticon.System.Users())
+
+	case "add":
+		fs := flag.NewFlagSet("user add", flag.ExitOnError)
+		privileged := fs.Bool("privileged", false, "allow the user to see private cameras and administer the system")
+		fs.Parse(args)
+		if fs.NArg() != 2 {
+			usage()
+		}
+		if panopticon.System.GetUser(fs.Arg(0)) != nil {
+			fail("user '%s' already exists", fs.Arg(0))
+		}
+		u := &panopticon.User{Email: fs.Arg(0), Name: fs.Arg(1), Privileged: *privileged}
+		if err := u.Validate(); err != nil {
+			fail("%s", err)
+		}
+		u.Store()
+		printUsers([]*panopticon.User{u})
+
+	case "grant", "revoke", "rm":
+		if len(args) != 1 {
+			usage()
+		}
+		u := panopticon.System.GetUser(args[0])
+		if u == nil {
+			fail("no such user '%s'", args[0])
+		}
+		if verb == "rm" {
+			u.Delete()
+			return
+		}
+		u.Privileged = verb == "grant"
+		u.Store()
+
+	default:
+		usage()
+	}
+}
+
+func printUsers(users []*panopticon.User) {
+	if *asJSON {
+		printJSON(users)
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "EMAIL\tNAME\tPRIVILEGED")
+	for _, u := range users {
+		fmt.Fprintf(tw, "%s\t%s\t%t\n", u.Email, u.Name, u.Privileged)
+	}
+	tw.Flush()
+}
+
+func settingCmd(verb string, args []string) {
+	switch verb {
+	case "get":
+		if len(args) > 1 {
+			usage()
+		}
+		settings := panopticon.System.Settings()
+		if len(args) == 1 {
+			v, ok := settings[args[0]]
+			if !ok {
+				fail("unknown setting '%s'", args[0])
+			}
+			settings = map[string]string{args[0]: v}
+		}
+		printSettings(settings)
+
+	case "set":
+		if len(args) != 2 {
+			usage()
+		}
+		if err := panopticon.System.SetSetting(args[0], args[1]); err != nil {
+			fail("%s", err)
+		}
+
+	default:
+		usage()
+	}
+}
+
+func printSettings(settings map[string]string) {
+	if *asJSON {
+		printJSON(settings)
+		return
+	}
+	keys := []string{}
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tVALUE")
+	for _, k := range keys {
+		fmt.Fprintf(tw, "%s\t%s\n", k, settings[k])
+	}
+	tw.Flush()
+}
+
+func printJSON(v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(b))
+}
@@ -62,6 +62,80 @@ var schemaStatements = [][]string{
 		"alter table Users add Privileged int not null default 0",
 		"update Version set Version=6",
 	},
+	[]string{
+		"create table Images (Handle text not null, Camera text not null, Timestamp datetime not null, HasVideo int not null default 0, unique (Handle, Camera))",
+		"create index i_c_ts on Images (Camera, Timestamp)",
+		"create table Pins (Handle text not null, Camera text not null, Kind text not null, Timestamp datetime not null, unique (Handle, Camera, Kind))",
+		"create index p_c_k_ts on Pins (Camera, Kind, Timestamp)",
+		"update Version set Version=7",
+	},
+	[]string{
+		"alter table Cameras add RetainCollected text not null default ''",
+		"alter table Cameras add RetainMotion text not null default ''",
+		"alter table Cameras add RetainGenerated text not null default ''",
+		"update Version set Version=8",
+	},
+	[]string{
+		"alter table Images add Size int not null default 0",
+		"update Version set Version=9",
+	},
+	[]string{
+		"create table CameraKeys (Camera text not null, Hash text not null unique, Prefix text not null, Created datetime not null, Expires datetime)",
+		"create index ck_c on CameraKeys (Camera)",
+		"update Version set Version=10",
+	},
+	[]string{
+		"create table EnrollmentTokens (Hash text not null unique, Camera text not null, Created datetime not null, Expires datetime not null)",
+		"update Version set Version=11",
+	},
+	[]string{
+		"alter table Cameras add StillInterval int not null default 0",
+		"create table CaptureStatus (Camera text not null, Source text not null, LastAttempt datetime not null, LastSuccess datetime, LastError text not null default '', Failures int not null default 0, unique (Camera, Source))",
+		"update Version set Version=12",
+	},
+	[]string{
+		"alter table Cameras add RetainRecorded text not null default ''",
+		"alter table Cameras add FrameInterval int not null default 0",
+		"alter table Cameras add SegmentLength int not null default 0",
+		"update Version set Version=13",
+	},
+	[]string{
+		"create table CameraActivity (Camera text not null unique, LastImage datetime not null)",
+		"insert into CameraActivity (Camera, LastImage) select Camera, max(Timestamp) from Pins where Kind in ('collected', 'motion') group by Camera",
+		"create table CameraGaps (Camera text not null, Start datetime not null, End datetime)",
+		"create index cg_c_s on CameraGaps (Camera, Start)",
+		"update Version set Version=14",
+	},
+	[]string{
+		"create table BatchUploads (Camera text not null, Hash text not null, Handle text not null default '', Received datetime not null, unique (Camera, Hash))",
+		"create index bu_r on BatchUploads (Received)",
+		"update Version set Version=15",
+	},
+	[]string{
+		"alter table Cameras add MotionSensitivity int not null default 0",
+		"create table MotionScores (Handle text not null, Camera text not null, Score real not null, unique (Handle, Camera))",
+		"update Version set Version=16",
+	},
+	[]string{
+		"create table MotionZones (Camera text not null, Name text not null, Mode text not null, Active int not null default 1, Points text not null, unique (Camera, Name))",
+		"update Version set Version=17",
+	},
+	[]string{
+		"create table ImageLabels (Handle text not null, Camera text not null, Label text not null, Confidence real not null, unique (Handle, Camera, Label))",
+		"create index il_c_l on ImageLabels (Camera, Label)",
+		"update Version set Version=18",
+	},
+	[]string{
+		"create table MotionEvents (ID integer primary key autoincrement, Camera text not null, Start datetime not null, End datetime not null, Frames int not null default 0, Still text not null default '', Reviewed int not null default 0, ReviewedBy text not null default '')",
+		"create index me_c_s on MotionEvents (Camera, Start)",
+		"create table MotionEventFrames (Event int not null, Handle text not null, Camera text not null, unique (Event, Handle))",
+		"create index mef_h_c on MotionEventFrames (Handle, Camera)",
+		"update Version set Version=19",
+	},
+	[]string{
+		"alter table Cameras add CaptureMode text not null default ''",
+		"update Version set Version=20",
+	},
 }
 
 func (sys *SystemConfig) getDB() *sql.DB {
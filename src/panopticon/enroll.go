@@ -0,0 +1,99 @@
+// Copyright © 2019 Dan Morrill
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panopticon
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"time"
+)
+
+/*
+ * Enrollment
+ *
+ * Rather than copying an API key onto a camera by hand, a privileged user can
+ * create an enrollment token for it, which is shown as a QR code along with
+ * this service's URL (see SystemConfig.QR.) The camera scans that, and posts
+ * the token to /camera/enroll, which exchanges it for the camera's ID and a
+ * freshly-rotated API key.
+ *
+ * Tokens are one-time: exchanging one deletes it. They also expire if unused.
+ * As with API keys, only their hashes are stored. A camera has at most one
+ * outstanding token; creating another cancels the previous one.
+ */
+
+// DefaultEnrollmentTTL is how long an enrollment token is good for, unless otherwise requested.
+const DefaultEnrollmentTTL = time.Hour
+
+// EnrollmentToken creates a one-time token with which the camera can enroll, good for `ttl`.
+// Returns the token and when it expires.
+func (c *Camera) EnrollmentToken(ttl time.Duration) (string, time.Time) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	token := hex.EncodeToString(b)
+
+	now := time.Now().UTC()
+	expires := now.Add(ttl)
+	System.writeDatabaseByQuery("delete from EnrollmentTokens where Camera=? or Expires <= ?", c.ID, now)
+	System.writeDatabaseByQuery("insert into EnrollmentTokens (Hash, Camera, Created, Expires) values (?, ?, ?, ?)",
+		hashCameraKey(token), c.ID, now, expires)
+
+	return token, expires.Local()
+}
+
+// CancelEnrollment invalidates the camera's outstanding enrollment token, if it has one.
+func (c *Camera) CancelEnrollment() {
+	System.writeDatabaseByQuery("delete from EnrollmentTokens where Camera=?", c.ID)
+}
+
+// Enroll exchanges an enrollment token for the camera it was created for, and a new API key for that
+// camera; any keys it previously had are revoked. Returns a nil Camera if the token is unknown,
+// expired, or already used.
+func (sys *SystemConfig) Enroll(token string) (*Camera, string) {
+	cxn := sys.getDB()
+	defer cxn.Close()
+
+	hash := hashCameraKey(token)
+	now := time.Now().UTC()
+
+	var camID string
+	err := cxn.QueryRow("select Camera from EnrollmentTokens where Hash=? and Expires > ?", hash, now).Scan(&camID)
+	if err == sql.ErrNoRows {
+		return nil, ""
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	// whoever deletes the token gets to use it, so that it can't be exchanged twice
+	res, err := cxn.Exec("delete from EnrollmentTokens where Hash=?", hash)
+	if err != nil {
+		panic(err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		panic(err)
+	} else if n != 1 {
+		return nil, ""
+	}
+
+	cam := sys.GetCamera(camID)
+	if cam == nil {
+		return nil, ""
+	}
+	return cam, cam.RotateKey(0)
+}
@@ -21,3 +21,9 @@ var appError = &APIResponse{Error: &APIError{Message: "There was a server error
 var clientError = &APIResponse{Error: &APIError{Message: "There was a client error in the application.", Extra: "", Recoverable: false}}
 var missingImage = &APIResponse{Error: &APIError{Message: "An image is unexpectedly missing.", Extra: "Try reloading the page.", Recoverable: true}}
 var noSuchCamera = &APIResponse{Error: &APIError{Message: "That camera is unknown.", Extra: "Try a different camera.", Recoverable: true}}
+var noSuchEvent = &APIResponse{Error: &APIError{Message: "That motion event is unknown.", Extra: "It may have expired.", Recoverable: true}}
+var notPrivileged = &APIResponse{Error: &APIError{Message: "You don't have permission to do that.", Extra: "Ask an administrator for help.", Recoverable: true}}
+var badMethod = &APIResponse{Error: &APIError{Message: "That operation isn't supported.", Extra: "", Recoverable: false}}
+var badCameraKey = &APIResponse{Error: &APIError{Message: "This camera is not authorized.", Extra: "Check the camera's API key.", Recoverable: false}}
+var noLiveStream = &APIResponse{Error: &APIError{Message: "That camera has no live stream.", Extra: "", Recoverable: true}}
+var streamUnavailable = &APIResponse{Error: &APIError{Message: "The camera's live stream isn't responding.", Extra: "Try again in a bit.", Recoverable: true}}
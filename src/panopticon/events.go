@@ -0,0 +1,203 @@
+// Copyright © 2019 Dan Morrill
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panopticon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"panopticon/messages"
+)
+
+/*
+ * Events
+ *
+ * Rather than re-polling /client/state, a client can hold open /client/events,
+ * a Server-Sent Events stream on which it's told about changes as they happen:
+ *   - "image" when a camera delivers a new image
+ *   - "pin" when an image is pinned as some kind (saved, motion, etc.)
+ *   - "timelapse" when a timelapse has been generated
+ *   - "camera" when a camera falls asleep or wakes, or goes offline or comes back
+ * Each event's data is a JSON messages.Event. Events for private cameras are
+ * only sent to privileged users.
+ *
+ * Delivery is best-effort. A client that falls too far behind is disconnected
+ * rather than being allowed to hold things up; browsers reconnect on their
+ * own, and clients should re-fetch /client/state whenever they (re)connect.
+ */
+
+const (
+	EventImage     = "image"
+	EventPin       = "pin"
+	EventTimelapse = "timelapse"
+	EventCamera    = "camera"
+)
+
+const (
+	eventBacklog   = 64               // how many events a subscriber can fall behind before it's dropped
+	eventKeepalive = 30 * time.Second // how often to send something on an otherwise idle stream
+)
+
+type eventHub struct {
+	lock   sync.Mutex
+	subs   map[chan *messages.Event]bool // value is whether the subscriber may see private cameras
+	states map[string]string             // last reported sleeping/offline state of each camera
+}
+
+var hub = &eventHub{subs: map[chan *messages.Event]bool{}, states: map[string]string{}}
+
+func (h *eventHub) subscribe(privileged bool) chan *messages.Event {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	ch := make(chan *messages.Event, eventBacklog)
+	h.subs[ch] = privileged
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan *messages.Event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// publish sends an event concerning `cam` to every subscriber allowed to see that camera.
+func (h *eventHub) publish(cam *Camera, evt *messages.Event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for ch, privileged := range h.subs {
+		if cam.Private && !privileged {
+			continue
+		}
+		select {
+		case ch <- evt:
+		default:
+			// too far behind; cut it loose, and let it catch up when it reconnects
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// listening indicates whether anyone is subscribed, so that callers can skip the work of
+// constructing events no one will receive.
+func (h *eventHub) listening() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.subs) > 0
+}
+
+// publishImage announces an image from its camera; `kind` is empty for a newly-delivered image, or
+// the kind it was just pinned as.
+func publishImage(img *Image, eventType string, kind MediaKind) {
+	if img == nil || !hub.listening() {
+		return
+	}
+	cam := System.GetCamera(img.Source)
+	if cam == nil {
+		return
+	}
+
+	t := img.Timestamp
+	if loc := cam.Location(); loc != nil {
+		t = t.In(loc)
+	}
+	hub.publish(cam, &messages.Event{
+		Type:   eventType,
+		Camera: cam.ID,
+		Kind:   string(kind),
+		Image: &messages.ImageMeta{
+			Handle:   img.Handle,
+			Time:     t.Format("3:04pm"),
+			Date:     t.Format("Monday, 2 January, 2006"),
+			HasVideo: img.HasVideo,
+		},
+	})
+}
+
+// publishCameraState announces the camera's sleeping/offline state if it has changed since it was
+// last checked. The first check of each camera only establishes its state.
+func publishCameraState(cam *Camera, sleeping bool, health *CameraHealth) {
+	state := fmt.Sprintf("%t %t", sleeping, health.Offline)
+	hub.lock.Lock()
+	prev, known := hub.states[cam.ID]
+	hub.states[cam.ID] = state
+	hub.lock.Unlock()
+
+	if !known || prev == state {
+		return
+	}
+	hub.publish(cam, &messages.Event{
+		Type:     EventCamera,
+		Camera:   cam.ID,
+		Sleeping: sleeping,
+		Offline:  health.Offline,
+		Message:  health.Message,
+	})
+}
+
+// EventsHandler handles /client/events, which streams events to the client as they occur.
+func EventsHandler(writer http.ResponseWriter, req *http.Request) {
+	u := userFor(req)
+	events := hub.subscribe(u.Privileged)
+	defer hub.unsubscribe(events)
+
+	// the response lasts as long as the client keeps listening, so it can't be subject to the server's
+	// usual write timeout
+	rc := http.NewResponseController(writer)
+	rc.SetWriteDeadline(time.Time{})
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(http.StatusOK)
+	if _, err := fmt.Fprintf(writer, "retry: %d\n\n", (5 * time.Second).Milliseconds()); err != nil {
+		return
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case evt, ok := <-events:
+			if !ok {
+				return
+			}
+			b, err := json.Marshal(evt)
+			if err != nil {
+				panic(err)
+			}
+			if _, err := fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", evt.Type, b); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(writer, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright © 2019 Dan Morrill
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panopticon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// EXIF tags we care about
+const (
+	exifTagIFDPointer         = 0x8769
+	exifTagDateTimeOriginal   = 0x9003
+	exifTagOffsetTimeOriginal = 0x9011
+)
+
+// exifCaptureTime extracts the DateTimeOriginal tag from a JPEG's EXIF segment, if it has one. EXIF
+// times are wall-clock times without a zone, so unless the image also carries OffsetTimeOriginal,
+// the time is interpreted in `loc`. Returns false if the image has no usable capture time.
+//
+// This implements only as much of JPEG & TIFF as is needed to find that one tag, rather than being
+// a general EXIF parser.
+func exifCaptureTime(b []byte, loc *time.Location) (time.Time, bool) {
+	tiff := exifSegment(b)
+	if tiff == nil || len(tiff) < 8 {
+		return time.Time{}, false
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return time.Time{}, false
+	}
+
+	// DateTimeOriginal lives in the Exif sub-IFD, which IFD0 points to
+	ifd0 := order.Uint32(tiff[4:8])
+	sub, ok := exifFindTag(tiff, order, ifd0, exifTagIFDPointer)
+	if !ok {
+		return time.Time{}, false
+	}
+	entry, ok := exifFindTag(tiff, order, order.Uint32(sub[8:12]), exifTagDateTimeOriginal)
+	if !ok {
+		return time.Time{}, false
+	}
+	raw, ok := exifASCII(tiff, order, entry)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	if entry, ok := exifFindTag(tiff, order, order.Uint32(sub[8:12]), exifTagOffsetTimeOriginal); ok {
+		if offset, ok := exifASCII(tiff, order, entry); ok {
+			if t, err := time.Parse("2006:01:02 15:04:05-07:00", raw+offset); err == nil {
+				return t, true
+			}
+		}
+	}
+
+	if loc == nil {
+		loc = time.Local
+	}
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", raw, loc)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// exifSegment walks the JPEG markers looking for an APP1 segment containing EXIF, and returns the
+// TIFF structure within it.
+func exifSegment(b []byte) []byte {
+	if len(b) < 4 || b[0] != 0xFF || b[1] != 0xD8 {
+		return nil
+	}
+	i := 2
+	for i+4 <= len(b) {
+		if b[i] != 0xFF {
+			return nil
+		}
+		marker := b[i+1]
+		if marker == 0xDA || marker == 0xD9 { // start of scan or end of image; metadata is behind us
+			return nil
+		}
+		size := int(binary.BigEndian.Uint16(b[i+2 : i+4]))
+		if size < 2 || i+2+size > len(b) {
+			return nil
+		}
+		payload := b[i+4 : i+2+size]
+		if marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			return payload[6:]
+		}
+		i += 2 + size
+	}
+	return nil
+}
+
+// exifFindTag scans the IFD at `offset` for `tag`, returning its 12-byte directory entry.
+func exifFindTag(tiff []byte, order binary.ByteOrder, offset uint32, tag uint16) ([]byte, bool) {
+	if int(offset)+2 > len(tiff) {
+		return nil, false
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		start := int(offset) + 2 + i*12
+		if start+12 > len(tiff) {
+			return nil, false
+		}
+		entry := tiff[start : start+12]
+		if order.Uint16(entry[:2]) == tag {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+// exifASCII decodes the value of an ASCII-typed directory entry.
+func exifASCII(tiff []byte, order binary.ByteOrder, entry []byte) (string, bool) {
+	if order.Uint16(entry[2:4]) != 2 { // 2 is the ASCII type
+		return "", false
+	}
+	// values of 4 bytes or fewer are stored inline, and larger ones are stored at an offset
+	count := int(order.Uint32(entry[4:8]))
+	value := entry[8:12]
+	if count > 4 {
+		offset := int(order.Uint32(entry[8:12]))
+		if offset+count > len(tiff) {
+			return "", false
+		}
+		value = tiff[offset : offset+count]
+	} else {
+		value = value[:count]
+	}
+	return strings.TrimRight(string(value), "\x00 "), true
+}
@@ -0,0 +1,158 @@
+// Copyright © 2019 Dan Morrill
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panopticon
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// exifTIFF builds a minimal TIFF structure with an Exif sub-IFD holding DateTimeOriginal and, if
+// `offset` isn't empty, OffsetTimeOriginal.
+func exifTIFF(order binary.ByteOrder, date string, offset string) []byte {
+	n := 1
+	if offset != "" {
+		n = 2
+	}
+	subStart := 8 + 2 + 12 + 4
+	dataStart := subStart + 2 + n*12 + 4
+
+	b := make([]byte, dataStart)
+	if order == binary.LittleEndian {
+		copy(b, "II")
+	} else {
+		copy(b, "MM")
+	}
+	order.PutUint16(b[2:], 42)
+	order.PutUint32(b[4:], 8)
+
+	// IFD0, pointing at the Exif sub-IFD
+	order.PutUint16(b[8:], 1)
+	order.PutUint16(b[10:], exifTagIFDPointer)
+	order.PutUint16(b[12:], 4)
+	order.PutUint32(b[14:], 1)
+	order.PutUint32(b[18:], uint32(subStart))
+
+	entry := func(i int, tag uint16, value string) {
+		e := b[subStart+2+i*12:]
+		order.PutUint16(e, tag)
+		order.PutUint16(e[2:], 2)
+		order.PutUint32(e[4:], uint32(len(value)+1))
+		order.PutUint32(e[8:], uint32(len(b)))
+		b = append(b, value...)
+		b = append(b, 0)
+	}
+	order.PutUint16(b[subStart:], uint16(n))
+	entry(0, exifTagDateTimeOriginal, date)
+	if offset != "" {
+		entry(1, exifTagOffsetTimeOriginal, offset)
+	}
+	return b
+}
+
+// exifJPEG wraps a TIFF structure in an APP1 segment at the start of a JPEG.
+func exifJPEG(tiff []byte) []byte {
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	b := []byte{0xFF, 0xD8, 0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(b[4:], uint16(len(payload)+2))
+	b = append(b, payload...)
+	return append(b, 0xFF, 0xDA, 0, 2, 0xFF, 0xD9)
+}
+
+func TestExifCaptureTime(t *testing.T) {
+	good := exifJPEG(exifTIFF(binary.LittleEndian, "2019:06:01 12:34:56", ""))
+	want := time.Date(2019, 6, 1, 12, 34, 56, 0, time.UTC)
+
+	corrupt := func(f func(b []byte) []byte) []byte {
+		b := append([]byte{}, good...)
+		return f(b)
+	}
+	tiffAt := 4 + 2 + 6 // SOI, APP1 marker and length, "Exif\0\0"
+
+	tests := []struct {
+		name string
+		b    []byte
+		want time.Time
+		ok   bool
+	}{
+		{"little-endian", good, want, true},
+		{"big-endian", exifJPEG(exifTIFF(binary.BigEndian, "2019:06:01 12:34:56", "")), want, true},
+		{"with offset", exifJPEG(exifTIFF(binary.BigEndian, "2019:06:01 12:34:56", "+02:00")), want.Add(-2 * time.Hour), true},
+		{"bad offset", exifJPEG(exifTIFF(binary.LittleEndian, "2019:06:01 12:34:56", "bogus")), want, true},
+		{"empty", nil, time.Time{}, false},
+		{"not a JPEG", []byte("GIF89a and so on"), time.Time{}, false},
+		{"no APP1", []byte{0xFF, 0xD8, 0xFF, 0xDA, 0, 2, 0xFF, 0xD9}, time.Time{}, false},
+		{"APP1 not EXIF", exifJPEG([]byte("http://ns.adobe.com/xap/1.0/")), time.Time{}, false},
+		{"APP1 length past end", good[:len(good)/2], time.Time{}, false},
+		{"APP1 length too small", corrupt(func(b []byte) []byte { b[4], b[5] = 0, 1; return b }), time.Time{}, false},
+		{"TIFF too short", exifJPEG([]byte("II*")), time.Time{}, false},
+		{"bad byte order", corrupt(func(b []byte) []byte { b[tiffAt] = 'X'; return b }), time.Time{}, false},
+		{"IFD0 past end", corrupt(func(b []byte) []byte {
+			binary.LittleEndian.PutUint32(b[tiffAt+4:], 0xFFFFFFF0)
+			return b
+		}), time.Time{}, false},
+		{"IFD0 entry count past end", corrupt(func(b []byte) []byte {
+			binary.LittleEndian.PutUint16(b[tiffAt+8:], 0xFFFF)
+			binary.LittleEndian.PutUint16(b[tiffAt+10:], 0x0100) // so the scan must go past the end
+			return b
+		}), time.Time{}, false},
+		{"sub-IFD past end", corrupt(func(b []byte) []byte {
+			binary.LittleEndian.PutUint32(b[tiffAt+18:], 0xFFFFFFF0)
+			return b
+		}), time.Time{}, false},
+		{"date offset past end", corrupt(func(b []byte) []byte {
+			binary.LittleEndian.PutUint32(b[tiffAt+26+2+8:], 0xFFFFFFF0)
+			return b
+		}), time.Time{}, false},
+		{"date not ASCII", corrupt(func(b []byte) []byte {
+			binary.LittleEndian.PutUint16(b[tiffAt+26+2+2:], 3)
+			return b
+		}), time.Time{}, false},
+		{"unparseable date", exifJPEG(exifTIFF(binary.LittleEndian, "0000:00:00 00:00:00", "")), time.Time{}, false},
+	}
+	for _, test := range tests {
+		got, ok := exifCaptureTime(test.b, time.UTC)
+		if ok != test.ok || !got.Equal(test.want) {
+			t.Errorf("%s: got %v, %t; want %v, %t", test.name, got, ok, test.want, test.ok)
+		}
+	}
+
+	// no truncation of a valid image may panic
+	for i := range good {
+		exifCaptureTime(good[:i], time.UTC)
+	}
+}
+
+func TestPlausibleCaptureTime(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		t    time.Time
+		want bool
+	}{
+		{"now", now, true},
+		{"within skew", now.Add(captureSkew / 2), true},
+		{"future", now.Add(time.Hour), false},
+		{"long ago", now.Add(-365 * 24 * time.Hour), true},
+		{"epoch", time.Unix(0, 0), false},
+		{"no RTC", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), false},
+	}
+	for _, test := range tests {
+		if got := plausibleCaptureTime(test.t); got != test.want {
+			t.Errorf("%s: got %t, want %t", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+// Copyright © 2019 Dan Morrill
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panopticon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"playground/log"
+)
+
+// FsckProblem categorizes an inconsistency found in the repository by Fsck.
+type FsckProblem string
+
+// enum constants for FsckProblem
+const (
+	FsckDanglingPin    FsckProblem = "dangling pin"
+	FsckMisdirectedPin FsckProblem = "misdirected pin"
+	FsckOrphanVideo    FsckProblem = "video without still"
+	FsckHashMismatch   FsckProblem = "hash mismatch"
+	FsckMisplacedData  FsckProblem = "misplaced data file"
+	FsckUnknownFile    FsckProblem = "unknown file"
+	FsckStrayDir       FsckProblem = "stray directory"
+	FsckUnknownCamera  FsckProblem = "unknown camera directory"
+	FsckIndexDrift     FsckProblem = "index out of sync"
+)
+
+// FsckFinding is a single inconsistency found by Fsck, and whether it was repaired.
+type FsckFinding struct {
+	Problem  FsckProblem
+	Path     string
+	Detail   string
+	Repaired bool
+}
+
+// quarantineDir is where Fsck moves files it can't make sense of, rather than deleting them. It
+// lives beneath BaseDirectory, but can't collide with a camera ID since those don't start with '.'.
+const quarantineDir = ".quarantine"
+
+type fsck struct {
+	repo     *RepositoryConfig
+	repair   bool
+	findings []*FsckFinding
+}
+
+// Fsck checks the repository tree for inconsistencies -- i.e. anything not laid out as described in
+// repo.go, or not matching the index -- and returns what it finds. If `repair` is false, nothing
+// is modified. Otherwise each problem is repaired as follows:
+//   - dangling pins are removed
+//   - misdirected pins are re-pointed at the canonical data file
+//   - data files whose contents don't match their handle are re-homed under the correct handle
+//   - data files in the wrong prefix directory are moved to the right one
+//   - videos without stills, unknown files, and stray directories are moved to BaseDirectory/.quarantine
+//   - the index is rebuilt, if it had drifted or anything else was repaired
+//
+// Directories for cameras that aren't configured are only reported, since they may just belong to a
+// camera that was deleted.
+func (repo *RepositoryConfig) Fsck(repair bool) []*FsckFinding {
+	f := &fsck{repo: repo, repair: repair}
+
+	cameras := System.Cameras()
+	known := map[string]bool{quarantineDir: true}
+	for _, cam := range cameras {
+		known[cam.ID] = true
+	}
+	entries, err := readDirIfExists(repo.BaseDirectory)
+	if err != nil {
+		panic(err)
+	}
+	for _, entry := range entries {
+		if !known[entry.Name()] {
+			f.report(FsckUnknownCamera, filepath.Join(repo.BaseDirectory, entry.Name()), "", false)
+		}
+	}
+
+	for _, cam := range cameras {
+		stills := f.checkData(cam.ID)
+		pins := f.checkPins(cam.ID, stills)
+		f.checkIndex(cam.ID, stills, pins)
+	}
+
+	if repair {
+		for _, finding := range f.findings {
+			if finding.Repaired || finding.Problem == FsckIndexDrift {
+				repo.Reindex()
+				break
+			}
+		}
+	}
+
+	return f.findings
+}
+
+func (f *fsck) report(problem FsckProblem, path string, detail string, repaired bool) {
+	log.Debug("RepositoryConfig.Fsck", fmt.Sprintf("%s: '%s' %s", problem, path, detail))
+	f.findings = append(f.findings, &FsckFinding{Problem: problem, Path: path, Detail: detail, Repaired: repaired})
+}
+
+// checkData examines a camera's data tree, returning the set of handles that have stills afterward.
+func (f *fsck) checkData(camera string) map[string]bool {
+	dataDir := filepath.Join(f.repo.BaseDirectory, camera, MediaData)
+	prefixes, err := readDirIfExists(dataDir)
+	if err != nil {
+		panic(err)
+	}
+
+	stills := make(map[string]string) // by handle
+	videos := make(map[string]string) // by file name, since there may be several renditions
+	for _, prefix := range prefixes {
+		path := filepath.Join(dataDir, prefix.Name())
+		if !prefix.IsDir() {
+			f.report(FsckUnknownFile, path, "", f.repair && f.quarantine(path))
+			continue
+		}
+		if len(prefix.Name()) != 3 {
+			f.report(FsckStrayDir, path, "", f.repair && f.quarantine(path))
+			continue
+		}
+		leaves, err := readDirIfExists(path)
+		if err != nil {
+			panic(err)
+		}
+		for _, leaf := range leaves {
+			leafPath := filepath.Join(path, leaf.Name())
+			if leaf.IsDir() {
+				f.report(FsckStrayDir, leafPath, "", f.repair && f.quarantine(leafPath))
+				continue
+			}
+			chunks := strings.Split(leaf.Name(), ".")
+			if len(chunks) != 2 || !handleRE.MatchString(chunks[0]) || mediaTypes[chunks[1]] == "" || !leaf.Mode().IsRegular() {
+				f.report(FsckUnknownFile, leafPath, "", f.repair && f.quarantine(leafPath))
+				continue
+			}
+			if chunks[0][:3] != prefix.Name() {
+				canon := f.repo.canonDataPath(camera, leaf.Name())
+				moved := f.repair && f.move(leafPath, canon)
+				f.report(FsckMisplacedData, leafPath, fmt.Sprintf("belongs at '%s'", canon), moved)
+				if moved {
+					leafPath = canon
+				}
+			}
+			if chunks[1] == "jpg" {
+				stills[chunks[0]] = leafPath
+			} else {
+				videos[leaf.Name()] = leafPath
+			}
+		}
+	}
+
+	handles := []string{}
+	for handle := range stills {
+		handles = append(handles, handle)
+	}
+	for _, handle := range handles {
+		path := stills[handle]
+		actual := hashFile(path)
+		if actual == handle {
+			continue
+		}
+		repaired := f.repair && f.rehome(camera, handle, actual, stills, videos)
+		f.report(FsckHashMismatch, path, fmt.Sprintf("contents hash to %s", actual), repaired)
+	}
+
+	for name, path := range videos {
+		if _, ok := stills[strings.Split(name, ".")[0]]; !ok {
+			f.report(FsckOrphanVideo, path, "", f.repair && f.quarantine(path))
+		}
+	}
+
+	ret := make(map[string]bool)
+	for handle := range stills {
+		ret[handle] = true
+	}
+	return ret
+}
+
+// rehome moves a still (and its video, and any pins of it) whose contents don't match its handle to
+// where its contents say it belongs. If something is already stored there, the mismatched file is
+// simply quarantined. `stills` and `videos` are updated to reflect the result.
+func (f *fsck) rehome(camera string, handle string, actual string, stills map[string]string, videos map[string]string) bool {
+	path := stills[handle]
+	delete(stills, handle)
+
+	canon := f.repo.canonDataPath(camera, fmt.Sprintf("%s.jpg", actual))
+	if _, err := os.Lstat(canon); err == nil {
+		return f.quarantine(path)
+	}
+	if !f.move(path, canon) {
+		return false
+	}
+	stills[actual] = canon
+
+	for _, ext := range videoRenditions {
+		name := fmt.Sprintf("%s.%s", handle, ext)
+		if video, ok := videos[name]; ok {
+			actualName := fmt.Sprintf("%s.%s", actual, ext)
+			videoCanon := f.repo.canonDataPath(camera, actualName)
+			if _, err := os.Lstat(videoCanon); os.IsNotExist(err) && f.move(video, videoCanon) {
+				delete(videos, name)
+				videos[actualName] = videoCanon
+			}
+		}
+	}
+
+	// carry over any pins of the old handle; this is the only place fsck creates pins
+	for _, kind := range AllKinds {
+		dir := filepath.Join(f.repo.BaseDirectory, camera, string(kind))
+		for _, ext := range mediaExtensions {
+			old := filepath.Join(dir, fmt.Sprintf("%s.%s", handle, ext))
+			if _, err := os.Lstat(old); err != nil {
+				continue
+			}
+			if err := os.Remove(old); err != nil {
+				panic(err)
+			}
+			target := f.repo.canonDataPath(camera, fmt.Sprintf("%s.%s", actual, ext))
+			if _, err := os.Stat(target); err != nil {
+				continue
+			}
+			link := filepath.Join(dir, fmt.Sprintf("%s.%s", actual, ext))
+			if err := os.Symlink(target, link); err != nil && !os.IsExist(err) {
+				panic(err)
+			}
+		}
+	}
+
+	return true
+}
+
+// checkPins examines a camera's kind directories, returning the set of healthy pins as "kind/handle".
+func (f *fsck) checkPins(camera string, stills map[string]bool) map[string]bool {
+	pins := make(map[string]bool)
+	for _, kind := range AllKinds {
+		dir := filepath.Join(f.repo.BaseDirectory, camera, string(kind))
+		entries, err := readDirIfExists(dir)
+		if err != nil {
+			panic(err)
+		}
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			if entry.IsDir() {
+				f.report(FsckStrayDir, path, "", f.repair && f.quarantine(path))
+				continue
+			}
+			chunks := strings.Split(entry.Name(), ".")
+			if len(chunks) != 2 || !handleRE.MatchString(chunks[0]) || mediaTypes[chunks[1]] == "" || entry.Mode()&os.ModeSymlink == 0 {
+				f.report(FsckUnknownFile, path, "", f.repair && f.quarantine(path))
+				continue
+			}
+
+			target, err := os.Readlink(path)
+			if err != nil {
+				panic(err)
+			}
+			canon := f.repo.canonDataPath(camera, entry.Name())
+			if _, err := os.Stat(path); err != nil {
+				f.report(FsckDanglingPin, path, fmt.Sprintf("points to missing '%s'", target), f.repair && f.remove(path))
+				continue
+			}
+			if target != canon {
+				if _, err := os.Stat(canon); err != nil {
+					f.report(FsckMisdirectedPin, path, fmt.Sprintf("points to '%s', and '%s' is missing", target, canon), false)
+					continue
+				}
+				f.report(FsckMisdirectedPin, path, fmt.Sprintf("points to '%s'", target), f.repair && f.relink(path, canon))
+			}
+			if chunks[1] == "jpg" && stills[chunks[0]] {
+				pins[fmt.Sprintf("%s/%s", kind, chunks[0])] = true
+			}
+		}
+	}
+	return pins
+}
+
+// checkIndex compares a camera's stills and pins on disk to what the index says.
+func (f *fsck) checkIndex(camera string, stills map[string]bool, pins map[string]bool) {
+	where := filepath.Join(f.repo.BaseDirectory, camera)
+	for handle := range f.repo.indexedImages(camera) {
+		if !stills[handle] {
+			f.report(FsckIndexDrift, where, fmt.Sprintf("indexed image %s is not on disk", handle), false)
+		}
+	}
+	indexed := f.repo.indexedPins(camera)
+	for pin := range indexed {
+		if !pins[pin] {
+			f.report(FsckIndexDrift, where, fmt.Sprintf("indexed pin %s is not on disk", pin), false)
+		}
+	}
+	for pin := range pins {
+		if !indexed[pin] {
+			f.report(FsckIndexDrift, where, fmt.Sprintf("pin %s is not indexed", pin), false)
+		}
+	}
+}
+
+// quarantine moves the indicated file or directory beneath BaseDirectory/.quarantine, preserving its
+// path relative to BaseDirectory.
+func (f *fsck) quarantine(path string) bool {
+	rel, err := filepath.Rel(f.repo.BaseDirectory, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		panic(fmt.Errorf("'%s' is not beneath BaseDirectory (%s)", path, f.repo.BaseDirectory))
+	}
+	dest := filepath.Join(f.repo.BaseDirectory, quarantineDir, rel)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(dest); os.IsNotExist(err) {
+			break
+		}
+		dest = fmt.Sprintf("%s.%d", filepath.Join(f.repo.BaseDirectory, quarantineDir, rel), i)
+	}
+	return f.move(path, dest)
+}
+
+func (f *fsck) move(from string, to string) bool {
+	if err := os.MkdirAll(filepath.Dir(to), 0770); err != nil {
+		log.Error("RepositoryConfig.Fsck", fmt.Sprintf("failed to create directory for '%s'", to), err)
+		return false
+	}
+	if err := os.Rename(from, to); err != nil {
+		log.Error("RepositoryConfig.Fsck", fmt.Sprintf("failed to move '%s' to '%s'", from, to), err)
+		return false
+	}
+	return true
+}
+
+func (f *fsck) remove(path string) bool {
+	if err := os.Remove(path); err != nil {
+		log.Error("RepositoryConfig.Fsck", fmt.Sprintf("failed to remove '%s'", path), err)
+		return false
+	}
+	return true
+}
+
+func (f *fsck) relink(link string, target string) bool {
+	return f.remove(link) && os.Symlink(target, link) == nil
+}
+
+// hashFile computes the handle that a file's contents should be stored under.
+func hashFile(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	potato := sha256.New()
+	if _, err := io.Copy(potato, file); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(potato.Sum(nil))
+}
@@ -16,10 +16,16 @@ package panopticon
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"image"
@@ -36,6 +42,9 @@ import (
 	"github.com/bradfitz/latlong"
 )
 
+// maxClipSize is the largest motion clip upload that will be accepted.
+const maxClipSize = 256 * 1024 * 1024
+
 // userFor looks up the User instance, primarily for its Privileged flag for use
 // in perms checks. This can return nil in principle, but we assume we're called
 // with the emailInspector sentinel.
@@ -46,19 +55,72 @@ func userFor(req *http.Request) *User {
 	return System.GetUser(session.GetSession(req).Email)
 }
 
-// ProvisionHandler handles /provision
+// ProvisionHandler handles /client/provision/<camera>, which creates an enrollment token for the
+// camera and returns a QR code for it. Only privileged users may use it. The token is good for an
+// hour, or for the duration in the optional `ttl` query parameter.
 func ProvisionHandler(writer http.ResponseWriter, req *http.Request) {
+	TAG := "panopticon.ProvisionHandler"
+	badReq := httputil.NewJSONAssertable(writer, TAG, http.StatusBadRequest, clientError)
+	notFound := httputil.NewJSONAssertable(writer, TAG, http.StatusNotFound, noSuchCamera)
+
+	u := requirePrivileged(writer, req, TAG)
+
+	camID := httputil.ExtractSegment(req.URL.Path, 3)
+	cam := System.GetCamera(camID)
+	notFound.Assert(cam != nil, "attempt to provision unknown camera '%s'", camID)
+
+	ttl := DefaultEnrollmentTTL
+	if raw := req.URL.Query().Get("ttl"); raw != "" {
+		var err error
+		ttl, err = ParseRetention(raw)
+		badReq.Assert(err == nil && ttl > 0, "invalid ttl '%s'", raw)
+	}
+
+	token, expires := cam.EnrollmentToken(ttl)
+	log.Status(TAG, fmt.Sprintf("'%s' created enrollment token for '%s', expiring %s", u.Email, cam.ID, expires))
+
 	buf := &bytes.Buffer{}
-	System.QR(buf)
+	System.QR(buf, token)
 
+	writer.Header().Set("Cache-Control", "no-store")
 	httputil.Send(writer, http.StatusOK, "image/png", buf.Bytes())
 }
 
+// EnrollHandler handles /camera/enroll, which exchanges an enrollment token for the camera's ID and
+// API key, along with how the camera should capture images (per its CaptureMode, StillInterval, and
+// MotionSensitivity.)
+func EnrollHandler(writer http.ResponseWriter, req *http.Request) {
+	TAG := "panopticon.EnrollHandler"
+	badReq := httputil.NewJSONAssertable(writer, TAG, http.StatusBadRequest, clientError)
+	unauthorized := httputil.NewJSONAssertable(writer, TAG, http.StatusUnauthorized, badCameraKey)
+
+	enrollment := &messages.Enrollment{}
+	err := json.NewDecoder(req.Body).Decode(enrollment)
+	badReq.Assert(err == nil && enrollment.Token != "", "malformed enrollment request (%s)", err)
+
+	cam, key := System.Enroll(enrollment.Token)
+	unauthorized.Assert(cam != nil, "attempt to enroll with unknown, expired, or used token")
+	log.Status(TAG, fmt.Sprintf("enrolled camera '%s'", cam.ID))
+
+	settings := System.Current()
+	httputil.SendJSON(writer, http.StatusOK, &APIResponse{Artifact: &messages.EnrollmentResult{
+		Camera:            cam.ID,
+		Name:              cam.Name,
+		Key:               key,
+		ServiceURL:        settings.HomeURL,
+		CaptureTimeHeader: settings.CaptureTimeHeader,
+		CaptureMode:       string(cam.CaptureMode),
+		CaptureInterval:   cam.StillInterval,
+		MotionSensitivity: cam.MotionSensitivity,
+	}})
+}
+
 // StateHandler handles /state
 func StateHandler(writer http.ResponseWriter, req *http.Request) {
+	settings := System.Current()
 	res := &messages.State{
-		ServiceName:  System.ServiceName,
-		DefaultImage: System.DefaultImage,
+		ServiceName:  settings.ServiceName,
+		DefaultImage: settings.DefaultImage,
 	}
 
 	// no camera specified, load them all
@@ -84,14 +146,14 @@ func StateHandler(writer http.ResponseWriter, req *http.Request) {
 			Name:        c.Name,
 			ID:          c.ID,
 			AspectRatio: c.AspectRatio,
+			HasLive:     c.RTSPURL != "",
 			LocalTime:   localNow.Format("3:04pm"),
 			LocalDate:   localNow.Format("Monday, 2 January, 2006"),
 			Sleeping:    c.IsDark(),
-
-			// currently unused fields
-			Message: "",
-			Offline: false,
 		}
+		health := c.Health()
+		mc.Offline = health.Offline
+		mc.Message = health.Message
 
 		var latest *Image
 
@@ -162,11 +224,13 @@ func ImageMetaHandler(writer http.ResponseWriter, req *http.Request) {
 		t = t.In(loc)
 	}
 	res := &messages.ImageMeta{
-		Handle:   img.Handle,
-		Camera:   camera.Name,
-		Time:     t.Format("3:04pm"),
-		Date:     t.Format("Monday, 2 January, 2006"),
-		HasVideo: img.HasVideo,
+		Handle:      img.Handle,
+		Camera:      camera.Name,
+		Time:        t.Format("3:04pm"),
+		Date:        t.Format("Monday, 2 January, 2006"),
+		HasVideo:    img.HasVideo,
+		MotionScore: img.MotionScore(),
+		Labels:      img.Labels(),
 	}
 
 	httputil.SendJSON(writer, http.StatusOK, &APIResponse{Artifact: res})
@@ -213,6 +277,24 @@ func ImageListHandler(writer http.ResponseWriter, req *http.Request) {
 		badReq.Assert(err == nil, "unparseable per value '%s' (%s)", raw, err)
 	}
 
+	// optionally, only images the classifier labeled as something, with some minimum confidence
+	if label := req.Form.Get("label"); label != "" {
+		confidence := 0.0
+		raw = req.Form.Get("confidence")
+		if raw != "" {
+			confidence, err = strconv.ParseFloat(raw, 64)
+			badReq.Assert(err == nil, "unparseable confidence value '%s' (%s)", raw, err)
+		}
+		labeled := Repository.labeled(camera, label, confidence)
+		filtered := []*Image{}
+		for _, img := range imgs {
+			if labeled[img.Handle] {
+				filtered = append(filtered, img)
+			}
+		}
+		imgs = filtered
+	}
+
 	res := []*messages.ImageMeta{}
 
 	if skip < len(imgs) {
@@ -224,6 +306,11 @@ func ImageListHandler(writer http.ResponseWriter, req *http.Request) {
 		if loc == nil {
 			loc = time.UTC
 		}
+		handles := []string{}
+		for _, img := range imgs[skip:end] {
+			handles = append(handles, img.Handle)
+		}
+		labels := Repository.labelsFor(camera, handles)
 		for _, img := range imgs[skip:end] {
 			ts := img.Timestamp.In(loc)
 			meta := &messages.ImageMeta{
@@ -232,6 +319,7 @@ func ImageListHandler(writer http.ResponseWriter, req *http.Request) {
 				Time:     ts.Format("3:04pm"),
 				Date:     ts.Format("Monday, 2 January, 2006"),
 				HasVideo: img.HasVideo,
+				Labels:   labels[img.Handle],
 			}
 			res = append(res, meta)
 		}
@@ -240,22 +328,26 @@ func ImageListHandler(writer http.ResponseWriter, req *http.Request) {
 	httputil.SendJSON(writer, http.StatusOK, &APIResponse{Artifact: &messages.ImageList{Camera: cam.Name, Total: len(imgs), Images: res}})
 }
 
-// ImageHandler handles /client/image and /client/video
+// ImageHandler handles /client/image and /client/video. Images may be requested with a `w` query
+// parameter, to fetch a copy scaled down to about that width. Videos may be requested with a `format`
+// query parameter (e.g. "mp4") to select a rendition; otherwise the best one for the Accept header is
+// chosen.
+//
+// Media is streamed from disk rather than buffered, with support for Range requests so that browsers
+// can seek within videos. Since a handle is the hash of the content, a given URL's response never
+// changes, so it gets a strong ETag and is cached indefinitely.
 func ImageHandler(writer http.ResponseWriter, req *http.Request) {
 	TAG := "panopticon.ImageHandler"
 	notFound := httputil.NewJSONAssertable(writer, TAG, http.StatusNotFound, missingImage)
 	badReq := httputil.NewJSONAssertable(writer, TAG, http.StatusBadRequest, clientError)
 
 	ctype := "image/jpeg"
-	var buf bytes.Buffer
+	var f *os.File
 
 	imgID := httputil.ExtractSegment(req.URL.Path, 3)
 	if imgID == "" || imgID == "undefined" {
-		if b, err := ioutil.ReadFile(Repository.DefaultImage); err == nil {
-			if n, err := buf.Write(b); n != len(b) || err != nil {
-				panic(err)
-			}
-		} else {
+		var err error
+		if f, err = os.Open(Repository.DefaultImage); err != nil {
 			panic(err)
 		}
 	} else {
@@ -270,14 +362,100 @@ func ImageHandler(writer http.ResponseWriter, req *http.Request) {
 		badReq.Assert(mode != "video" || img.HasVideo, "attempt to access video for non-video '%s'", img.Handle, *img)
 
 		if mode == "video" {
-			ctype = "video/x-msvideo"
-			img.RetrieveVideo(&buf)
+			ext := req.URL.Query().Get("format")
+			if ext == "" {
+				ext = negotiateRendition(img, req.Header.Get("Accept"))
+			}
+			badReq.Assert(ext != "jpg" && mediaTypes[ext] != "", "unknown video format '%s' requested for '%s'", ext, img.Handle)
+			notFound.Assert(img.HasRendition(ext), "no %s rendition of '%s'", ext, img.Handle)
+			ctype = mediaTypes[ext]
+			f = img.OpenVideo(ext)
+			writer.Header().Set("Vary", "Accept")
+		} else if w := req.URL.Query().Get("w"); w != "" {
+			width, err := strconv.Atoi(w)
+			badReq.Assert(err == nil && width > 0, "invalid width '%s' requested for '%s'", w, img.Handle)
+			f = img.OpenResized(width)
+		} else {
+			f = img.Open()
+		}
+
+		// the file name is the handle (plus width, for derivatives) and extension, so it makes a fine
+		// ETag for a still, which never changes; but which rendition of a video is served can change
+		// as renditions are added, so video responses are revalidated, against the file's size and
+		// modification time too
+		tag := filepath.Base(f.Name())
+		if mode == "video" {
+			fi, err := f.Stat()
+			if err != nil {
+				f.Close()
+				panic(err)
+			}
+			writer.Header().Set("ETag", fmt.Sprintf("\"%s-%d-%d\"", tag, fi.Size(), fi.ModTime().UnixNano()))
+			writer.Header().Set("Cache-Control", "private, no-cache")
 		} else {
-			img.Retrieve(&buf)
+			writer.Header().Set("ETag", fmt.Sprintf("\"%s\"", tag))
+			writer.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
 		}
 	}
+	defer f.Close()
 
-	httputil.Send(writer, http.StatusOK, ctype, buf.Bytes())
+	fi, err := f.Stat()
+	if err != nil {
+		panic(err)
+	}
+	writer.Header().Set("Content-Type", ctype)
+	http.ServeContent(writer, req, "", fi.ModTime(), f)
+}
+
+// negotiateRendition picks which available rendition of an image's video best satisfies an Accept
+// header, preferring renditions in the order of `videoRenditions` when the header doesn't decide.
+func negotiateRendition(img *Image, accept string) string {
+	best, bestQ := videoRenditions[0], -1.0
+	for _, ext := range videoRenditions {
+		if !img.HasRendition(ext) {
+			continue
+		}
+		if q := acceptQuality(accept, mediaTypes[ext]); q > bestQ {
+			best, bestQ = ext, q
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the quality an Accept header assigns to a MIME type, taking the most specific
+// matching range. An empty header accepts everything.
+func acceptQuality(accept string, mimeType string) float64 {
+	if strings.TrimSpace(accept) == "" {
+		return 1
+	}
+	major := strings.SplitN(mimeType, "/", 2)[0]
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(params[0]))
+		s := -1
+		switch mediaRange {
+		case mimeType:
+			s = 2
+		case major + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+		specificity, q = s, 1
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = v
+				}
+			}
+		}
+	}
+	return q
 }
 
 // SaveHandler handles /client/save/
@@ -313,38 +491,254 @@ func LatestHandler(writer http.ResponseWriter, req *http.Request) {
 	processUpload(writer, req, MediaCollected)
 }
 
+// uploader returns the camera making a request, which is whichever one its key belongs to; a camera
+// ID header, if sent, must agree.
+func uploader(writer http.ResponseWriter, req *http.Request, TAG string) *Camera {
+	badReq := httputil.NewJSONAssertable(writer, TAG, http.StatusBadRequest, clientError)
+	unauthorized := httputil.NewJSONAssertable(writer, TAG, http.StatusUnauthorized, badCameraKey)
+
+	key := bearerToken(req)
+	unauthorized.Assert(key != "", "upload without a camera key")
+	cam := System.CameraForKey(key)
+	unauthorized.Assert(cam != nil, "upload with unknown or revoked camera key")
+	if header := System.Current().CameraIDHeader; header != "" {
+		if claimed := req.Header.Get(header); claimed != "" {
+			badReq.Assert(claimed == cam.ID, "camera '%s' claims to be '%s'", cam.ID, claimed)
+		}
+	}
+	return cam
+}
+
 func processUpload(writer http.ResponseWriter, req *http.Request, kind MediaKind) {
 	TAG := "panopticon.processUpload"
 	badReq := httputil.NewJSONAssertable(writer, TAG, http.StatusBadRequest, clientError)
 	ise := httputil.NewJSONAssertable(writer, TAG, http.StatusInternalServerError, internalError)
-	notFound := httputil.NewJSONAssertable(writer, TAG, http.StatusNotFound, noSuchCamera)
 
-	camID := req.Header.Get(System.CameraIDHeader)
-	badReq.Assert(camID != "", "missing camera ID header")
+	cam := uploader(writer, req, TAG)
 
-	cam := System.GetCamera(camID)
-	notFound.Assert(cam != nil, "attempt to upload by unknown '%s'", camID)
+	// the capture time the camera sent us separately, if any, is used only if the image itself doesn't
+	// record one
+	var captured time.Time
+	var err error
+	if header := System.Current().CaptureTimeHeader; header != "" {
+		if raw := req.Header.Get(header); raw != "" {
+			captured, err = parseCaptureTime(raw)
+			badReq.Assert(err == nil, "unparseable capture time '%s' (%s)", raw, err)
+		}
+	}
+
+	// motion uploads may be a video clip rather than just an image
+	if kind == MediaMotion && strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/") {
+		processClip(writer, req, cam, captured)
+		return
+	}
 
 	b, err := ioutil.ReadAll(req.Body)
 	ise.Assert(err == nil, "error loading request (%s)", err)
-	img, _, err := image.Decode(bytes.NewReader(b))
+
+	handle, err := ingest(cam, b, captured, kind)
 	badReq.Assert(err == nil, "bytes uploaded are not an image (%s)", err)
+	if handle == nil {
+		// camera is sleeping; this isn't an error, since cameras are assumed to be dumb and not
+		// implementing this behavior
+		httputil.SendJSON(writer, http.StatusAccepted, &APIResponse{Artifact: struct{}{}})
+		return
+	}
+	res := &struct{ Handle, Timestamp string }{handle.Handle, handle.PrettyTime()}
+
+	httputil.SendJSON(writer, http.StatusAccepted, &APIResponse{Artifact: res})
+}
+
+// processClip handles a motion upload sent as multipart/form-data, consisting of a video clip (the
+// "video" part, in any of `videoRenditions`) and optionally a still to go with it (the "image" part.)
+// Without a still, the clip's first frame is used.
+func processClip(writer http.ResponseWriter, req *http.Request, cam *Camera, captured time.Time) {
+	TAG := "panopticon.processClip"
+	badReq := httputil.NewJSONAssertable(writer, TAG, http.StatusBadRequest, clientError)
 
-	// check local sunrise/sunset times (w/ 15m window either direction) and don't bother to record night images
-	// note that this isn't an error: cameras are assumed to be dumb and not implementing this behavior
+	// as with stills, there's no point in even looking at these at night
 	if cam.IsDark() {
 		httputil.SendJSON(writer, http.StatusAccepted, &APIResponse{Artifact: struct{}{}})
 		return
 	}
 
-	// convert to JPEG; could save CPU by not re-encoding if already JPEG, but might as well anyway for safety
-	var buf bytes.Buffer
-	err = jpeg.Encode(&buf, img, nil)
-	ise.Assert(err == nil, "error converting to JPEG (%s)", err)
+	req.Body = http.MaxBytesReader(writer, req.Body, maxClipSize)
+	mr, err := req.MultipartReader()
+	badReq.Assert(err == nil, "malformed multipart upload (%s)", err)
+
+	var still, video []byte
+	var ext string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		badReq.Assert(err == nil, "malformed multipart upload (%s)", err)
+		switch part.FormName() {
+		case "video":
+			ext = clipRendition(part.Header.Get("Content-Type"), part.FileName())
+			badReq.Assert(ext != "", "unsupported video '%s' of type '%s'", part.FileName(), part.Header.Get("Content-Type"))
+			video, err = ioutil.ReadAll(part)
+		case "image":
+			still, err = ioutil.ReadAll(part)
+		default:
+			log.Warn(TAG, fmt.Sprintf("ignoring unexpected part '%s' in upload from '%s'", part.FormName(), cam.ID))
+		}
+		badReq.Assert(err == nil, "error reading '%s' part (%s)", part.FormName(), err)
+	}
+	badReq.Assert(len(video) > 0, "motion upload from '%s' without a video clip", cam.ID)
+
+	if len(still) == 0 {
+		still, err = clipCover(video, ext)
+		badReq.Assert(err == nil, "unable to extract a cover frame from clip (%s)", err)
+	}
 
-	handle := Repository.Store(camID, buf.Bytes())
-	handle.Pin(kind)
+	handle, err := ingestVideo(cam, still, captured, MediaMotion, ext, video)
+	badReq.Assert(err == nil, "still uploaded is not an image (%s)", err)
+	if handle == nil {
+		httputil.SendJSON(writer, http.StatusAccepted, &APIResponse{Artifact: struct{}{}})
+		return
+	}
 	res := &struct{ Handle, Timestamp string }{handle.Handle, handle.PrettyTime()}
 
 	httputil.SendJSON(writer, http.StatusAccepted, &APIResponse{Artifact: res})
 }
+
+// clipRendition determines which of `videoRenditions` an uploaded clip is, from its declared type or
+// failing that its file name. Returns "" if it's none of them.
+func clipRendition(ctype string, filename string) string {
+	for _, ext := range videoRenditions {
+		if strings.HasPrefix(strings.ToLower(ctype), mediaTypes[ext]) {
+			return ext
+		}
+	}
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+	for _, candidate := range videoRenditions {
+		if ext == candidate {
+			return ext
+		}
+	}
+	return ""
+}
+
+// clipCover extracts the first frame of a video clip, for use as its still.
+func clipCover(video []byte, ext string) ([]byte, error) {
+	// ffmpeg needs to seek in some containers (MP4 with its index at the end, say), so it can't simply
+	// be piped the clip
+	f, err := ioutil.TempFile("", fmt.Sprintf("panopticon-clip-*.%s", ext))
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(video); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return extractFrame(f.Name())
+}
+
+// ingest is the common path for new images from cameras, however they arrive: it decodes the
+// bytes, drops them if the camera is sleeping, and otherwise stores them and pins them as `kind`.
+// `captured` is the capture time to use if the image doesn't record its own, and may be zero.
+// Returns a nil Image if the image was dropped (e.g. taken while the camera is asleep, so long ago
+// that it would be purged right away, or showing no motion in its zones), or an error if the bytes
+// aren't an image.
+func ingest(cam *Camera, b []byte, captured time.Time, kind MediaKind) (*Image, error) {
+	return ingestVideo(cam, b, captured, kind, "", nil)
+}
+
+// ingestVideo is ingest for an image that comes with a video, which is linked as the `ext` rendition
+// before the image is pinned. The video may be nil, in which case this is the same as ingest.
+func ingestVideo(cam *Camera, b []byte, captured time.Time, kind MediaKind, ext string, video []byte) (*Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	// prefer the capture time recorded by the camera in the image itself; failing that and `captured`,
+	// Store will just use the current time. Either is ignored if it's implausible, though.
+	if t, ok := exifCaptureTime(b, cam.Location()); ok {
+		if plausibleCaptureTime(t) {
+			captured = t
+		} else {
+			log.Warn("ingest", fmt.Sprintf("ignoring implausible EXIF capture time %s from '%s'", t.Format(time.RFC3339), cam.ID))
+		}
+	}
+	if !captured.IsZero() && !plausibleCaptureTime(captured) {
+		log.Warn("ingest", fmt.Sprintf("ignoring implausible capture time %s from '%s'", captured.Format(time.RFC3339), cam.ID))
+		captured = time.Time{}
+	}
+
+	// an image arriving after its retention period would only be purged that night, and filing it
+	// under the current time instead would misplace it
+	if !captured.IsZero() && captured.Before(time.Now().Add(-Repository.Retention(cam, kind))) {
+		log.Warn("ingest", fmt.Sprintf("dropping '%s' image from '%s' captured %s, past its retention", kind, cam.ID, captured.Format(time.RFC3339)))
+		return nil, nil
+	}
+
+	// check local sunrise/sunset times (w/ 15m window either direction) and don't bother to record night
+	// images; this goes by when the image was taken, since it may be arriving late
+	if cam.IsDarkAt(captured) {
+		return nil, nil
+	}
+
+	// see whether the picture has changed where it matters; motion uploads showing nothing new inside
+	// the camera's zones aren't worth keeping
+	check := observeMotion(cam, img, captured)
+	if kind == MediaMotion && check.outsideZones() {
+		log.Debug("ingest", fmt.Sprintf("dropping motion from '%s' outside its zones", cam.ID))
+		return nil, nil
+	}
+
+	// convert to JPEG; could save CPU by not re-encoding if already JPEG, but might as well anyway for safety
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		panic(fmt.Errorf("error converting to JPEG (%s)", err))
+	}
+
+	handle := Repository.Store(cam.ID, buf.Bytes(), captured)
+	if video != nil {
+		if handle.HasRendition(ext) {
+			log.Warn("ingest", fmt.Sprintf("'%s' already has a %s video; discarding duplicate", handle.Handle, ext))
+		} else {
+			handle.LinkRendition(ext, video)
+		}
+	}
+	if handle.Pin(kind) && kind == MediaMotion {
+		groupMotion(handle)
+	}
+	cam.noteImage()
+	publishImage(handle, EventImage, "")
+	if kind == MediaCollected {
+		analyzeMotion(cam, handle, check)
+	}
+	classifyLater(handle)
+	if Repository.OverQuota(cam.ID) {
+		Repository.EnforceQuotasSoon()
+	}
+	return handle, nil
+}
+
+// captureSkew is how far in the future a capture time can be, to allow for cameras' clocks drifting.
+const captureSkew = 5 * time.Minute
+
+// clockUnset is when no image could have been captured before, since Panopticon didn't exist yet.
+var clockUnset = time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// plausibleCaptureTime indicates whether a capture time claimed by a camera could be right at all:
+// not in the future, nor before the camera's clock can have been set. Cameras without a real-time
+// clock tend to claim 1970 or 2000 until they sync, and a clock set ahead would keep images forever.
+func plausibleCaptureTime(t time.Time) bool {
+	return !t.After(time.Now().Add(captureSkew)) && !t.Before(clockUnset)
+}
+
+// parseCaptureTime accepts either an RFC 3339 timestamp or integer seconds since the Unix epoch.
+func parseCaptureTime(raw string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, raw)
+}
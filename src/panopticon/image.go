@@ -22,6 +22,7 @@ import (
 	"image"
 	"image/color"
 	"image/jpeg"
+	"io"
 	"io/ioutil"
 	"math"
 	"os"
@@ -32,6 +33,21 @@ import (
 	"playground/log"
 )
 
+// mediaTypes maps the extensions of data files to their MIME types.
+var mediaTypes = map[string]string{
+	"jpg":  "image/jpeg",
+	"webm": "video/webm",
+	"mp4":  "video/mp4",
+}
+
+// videoRenditions are the extensions of the forms an image's video may be stored in, in order of
+// preference. A video has at least one of them: timelapses always have a WebM rendition, while video
+// recorded from a camera's stream (which isn't re-encoded) is only MP4.
+var videoRenditions = []string{"webm", "mp4"}
+
+// mediaExtensions are the extensions of all the data files an image may have.
+var mediaExtensions = append([]string{"jpg"}, videoRenditions...)
+
 // Image represents an image file stored on disk.
 type Image struct {
 	Handle    string
@@ -41,13 +57,20 @@ type Image struct {
 }
 
 // CreateImage stores the bytes to the disk according to config & convention, and returns a handle to the
-// resulting image.
-func CreateImage(source string, b []byte) *Image {
+// resulting image. `captured` is when the image was actually taken; if it's zero, the current time is
+// used instead, and an image that already exists keeps whatever capture time it was first stored with.
+func CreateImage(source string, b []byte, captured time.Time) *Image {
 	cam := System.GetCamera(source)
 	if cam.Dewarp {
 		b = dewarpFisheye(b)
 	}
 
+	return storeImage(source, b, captured)
+}
+
+// storeImage is CreateImage without any processing of the bytes, i.e. for when they were already
+// processed, such as by another instance that exported them.
+func storeImage(source string, b []byte, captured time.Time) *Image {
 	// image's stable ID is its hash
 	potato := sha256.New()
 	potato.Write(b)
@@ -70,37 +93,94 @@ func CreateImage(source string, b []byte) *Image {
 		}
 	}
 
-	stat, err := os.Stat(diskPath)
-	if err != nil {
-		panic(err)
+	authoritative := !captured.IsZero()
+	if !authoritative {
+		captured = time.Now()
 	}
 
-	return &Image{
+	// also record the capture time as the file's mtime, so that Reindex can recover it
+	if fi == nil || authoritative {
+		if err := os.Chtimes(diskPath, captured, captured); err != nil {
+			panic(err)
+		}
+	}
+
+	img := &Image{
 		Handle:    handle,
 		Source:    source,
-		Timestamp: stat.ModTime(),
+		Timestamp: captured,
 		HasVideo:  false,
 	}
+	Repository.indexImage(img, authoritative)
+
+	return Repository.lookupImage(handle, source)
 }
 
 // LinkVideo associates video bytes with the image, which is understood to be a
 // still frame from the video, suitable for use as a thumbnail or cover still
 // for the video. Errors if the image is not a video type (i.e. generated/timelapse.)
 func (img *Image) LinkVideo(content []byte) {
-	basename := fmt.Sprintf("%s.%s", img.Handle, "webm")
+	img.LinkRendition("webm", content)
+}
+
+// LinkRendition is like LinkVideo, but for a rendition of the video other than the WebM, which must
+// be one of `videoRenditions`. As with LinkVideo, renditions should be linked before pinning.
+// Renditions are write-once: this panics if the image already has the rendition, rather than
+// replacing a video that clients may have cached.
+func (img *Image) LinkRendition(ext string, content []byte) {
+	if mediaTypes[ext] == "" || ext == "jpg" {
+		panic(fmt.Errorf("unknown video rendition '%s'", ext))
+	}
+	basename := fmt.Sprintf("%s.%s", img.Handle, ext)
 	dataPath := Repository.dataPath(img.Source, basename)
-	if fi, err := os.Stat(dataPath); err != nil {
-		if !os.IsNotExist(err) {
-			panic(err)
-		}
-	} else {
-		if fi != nil {
-			log.Error("Image.LinkVideo", "image '%s' already has video", img.Handle)
-		}
+	if _, err := os.Stat(dataPath); err == nil {
+		panic(fmt.Errorf("image '%s' already has %s video", img.Handle, ext))
+	} else if !os.IsNotExist(err) {
+		panic(err)
 	}
 	if err := ioutil.WriteFile(dataPath, content, 0660); err != nil {
 		panic(err)
 	}
+	img.HasVideo = true
+	Repository.indexVideo(img)
+}
+
+// copyRendition is like LinkRendition, but copies the video from a reader, via a temporary file so
+// that a partial copy is never mistaken for the video.
+func (img *Image) copyRendition(ext string, r io.Reader) {
+	if mediaTypes[ext] == "" || ext == "jpg" {
+		panic(fmt.Errorf("unknown video rendition '%s'", ext))
+	}
+	dataPath := Repository.dataPath(img.Source, fmt.Sprintf("%s.%s", img.Handle, ext))
+	tmp, err := ioutil.TempFile(filepath.Dir(dataPath), ".partial-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chmod(tmp.Name(), 0660); err != nil {
+		panic(err)
+	}
+	if err := os.Rename(tmp.Name(), dataPath); err != nil {
+		panic(err)
+	}
+	img.HasVideo = true
+	Repository.indexVideo(img)
+}
+
+// HasRendition indicates whether the image's video is available in the indicated rendition.
+func (img *Image) HasRendition(ext string) bool {
+	_, err := os.Stat(Repository.canonDataPath(img.Source, fmt.Sprintf("%s.%s", img.Handle, ext)))
+	if err != nil && !os.IsNotExist(err) {
+		panic(err)
+	}
+	return err == nil
 }
 
 // Pin sets the Image to be pinned. `kind` must be one of the `Media*` enum constants. This is a
@@ -156,23 +236,28 @@ func (img *Image) Pin(kind MediaKind) bool {
 		}
 	} else {
 		log.Debug("Image.Pin", "double pin of '%s' to '%s'", img.Handle, kind)
+		Repository.indexPin(img, kind, time.Now()) // no-op unless the index had drifted
 		return false
 	}
 
-	// also link the video adjunct, if there is one
-	basename = fmt.Sprintf("%s.%s", img.Handle, "webm")
-	dataPath = Repository.dataPath(img.Source, basename)
-	fi, err = os.Stat(dataPath)
-	if err != nil && !os.IsNotExist(err) {
-		panic(err)
+	// also link the video adjuncts, if there are any
+	for _, ext := range videoRenditions {
+		basename = fmt.Sprintf("%s.%s", img.Handle, ext)
+		dataPath = Repository.dataPath(img.Source, basename)
+		fi, err = os.Stat(dataPath)
+		if err != nil && !os.IsNotExist(err) {
+			panic(err)
+		}
+		if err == nil && fi != nil {
+			destFile = Repository.canonFile(filepath.Join(destDir, basename))
+			if err := os.Symlink(dataPath, destFile); err != nil {
+				panic(err)
+			}
+		}
 	}
-	if !os.IsNotExist(err) && fi != nil {
 
-	}
-	destFile = Repository.canonFile(filepath.Join(destDir, basename))
-	if err := os.Symlink(dataPath, destFile); err != nil {
-		panic(err)
-	}
+	Repository.indexPin(img, kind, time.Now())
+	publishImage(img, EventPin, kind)
 	return true
 }
 
@@ -192,21 +277,24 @@ func (img *Image) Retrieve(buf *bytes.Buffer) {
 	}
 }
 
-// RetrieveVideo fetches the bytes of the video for which the image is a still.
-// Besides the usual errors, this will also error if the image is not a
-// video-carrying Kind.
-func (img *Image) RetrieveVideo(buf *bytes.Buffer) {
-	fname := strings.Join([]string{img.Handle, "webm"}, ".")
-	fname = Repository.dataPath(img.Source, fname)
-	if b, err := ioutil.ReadFile(fname); err != nil {
+// Open opens the image's data file for reading. The caller must close it.
+func (img *Image) Open() *os.File {
+	return openData(Repository.canonDataPath(img.Source, fmt.Sprintf("%s.%s", img.Handle, "jpg")))
+}
+
+// OpenVideo opens the data file of the indicated rendition of the video for which the image is a
+// still. The caller must close it. Besides the usual errors, this will also error if the image has no
+// video in that rendition.
+func (img *Image) OpenVideo(ext string) *os.File {
+	return openData(Repository.canonDataPath(img.Source, fmt.Sprintf("%s.%s", img.Handle, ext)))
+}
+
+func openData(file string) *os.File {
+	f, err := os.Open(Repository.canonFile(file))
+	if err != nil {
 		panic(err)
-	} else {
-		if n, err := buf.Write(b); err != nil {
-			panic(err)
-		} else if n != len(b) {
-			panic("partial write to memory buffer")
-		}
 	}
+	return f
 }
 
 // PrettyTime returns a cute human-readable version of the hours and minutes of `img.Timestamp`.
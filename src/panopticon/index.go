@@ -0,0 +1,421 @@
+// Copyright © 2019 Dan Morrill
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panopticon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"playground/log"
+)
+
+/*
+ * Media Index
+ *
+ * The filesystem (see "Directory Structure" in repo.go) remains the source of
+ * truth for what media exists, but scanning it is linear in the number of
+ * files, and the UI asks for recent images on every poll. So the Images and
+ * Pins tables mirror the data files and kind symlinks, respectively, and all
+ * lookups are served from them.
+ *
+ * Anything that changes the tree -- CreateImage, LinkVideo, Pin, PurgeBefore
+ * and GC -- must also update the index. If the two drift (e.g. after manual
+ * surgery on the tree), Reindex rebuilds the tables from disk.
+ */
+
+var handleRE = regexp.MustCompile("^[a-fA-F0-9]{64}$")
+
+// indexImage records an image. If it's already indexed, its capture time is only replaced if
+// `authoritative` is set, i.e. if the new time came from the image or camera rather than our clock.
+func (repo *RepositoryConfig) indexImage(img *Image, authoritative bool) {
+	q := "insert into Images (Handle, Camera, Timestamp, HasVideo, Size) values (?, ?, ?, ?, ?) on conflict(Handle, Camera) do update set Size=excluded.Size"
+	if authoritative {
+		q += ", Timestamp=excluded.Timestamp"
+	}
+	System.writeDatabaseByQuery(q, img.Handle, img.Source, img.Timestamp.UTC(), img.HasVideo, repo.diskSize(img))
+}
+
+func (repo *RepositoryConfig) indexVideo(img *Image) {
+	System.writeDatabaseByQuery("update Images set HasVideo=1, Size=? where Handle=? and Camera=?", repo.diskSize(img), img.Handle, img.Source)
+}
+
+// unindexImage drops an image from the index entirely, along with any pins it still had.
+func (repo *RepositoryConfig) unindexImage(img *Image) {
+	System.writeDatabaseByQuery("delete from Pins where Handle=? and Camera=?", img.Handle, img.Source)
+	System.writeDatabaseByQuery("delete from Images where Handle=? and Camera=?", img.Handle, img.Source)
+	System.writeDatabaseByQuery("delete from MotionScores where Handle=? and Camera=?", img.Handle, img.Source)
+	System.writeDatabaseByQuery("delete from ImageLabels where Handle=? and Camera=?", img.Handle, img.Source)
+	System.writeDatabaseByQuery("delete from MotionEventFrames where Handle=? and Camera=?", img.Handle, img.Source)
+}
+
+// diskSize totals the bytes in an image's data files, i.e. its still and any renditions of its video.
+func (repo *RepositoryConfig) diskSize(img *Image) int64 {
+	var size int64
+	for _, ext := range mediaExtensions {
+		fi, err := os.Stat(repo.dataPath(img.Source, fmt.Sprintf("%s.%s", img.Handle, ext)))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			panic(err)
+		}
+		size += fi.Size()
+	}
+	return size
+}
+
+// indexPin records a pin, returning false if the image was already pinned as that kind.
+func (repo *RepositoryConfig) indexPin(img *Image, kind MediaKind, when time.Time) bool {
+	cxn := System.getDB()
+	defer cxn.Close()
+
+	q := "insert into Pins (Handle, Camera, Kind, Timestamp) values (?, ?, ?, ?) on conflict(Handle, Camera, Kind) do nothing"
+	res, err := cxn.Exec(q, img.Handle, img.Source, string(kind), when.UTC())
+	if err != nil {
+		panic(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		panic(err)
+	}
+	return n > 0
+}
+
+func (repo *RepositoryConfig) unindexPin(img *Image, kind MediaKind) {
+	System.writeDatabaseByQuery("delete from Pins where Handle=? and Camera=? and Kind=?", img.Handle, img.Source, string(kind))
+}
+
+// pinCount returns the number of kinds as which an image is currently pinned.
+func (repo *RepositoryConfig) pinCount(img *Image) int {
+	cxn := System.getDB()
+	defer cxn.Close()
+
+	count := 0
+	if err := cxn.QueryRow("select count(*) from Pins where Handle=? and Camera=?", img.Handle, img.Source).Scan(&count); err != nil {
+		panic(err)
+	}
+	return count
+}
+
+// usage returns the total bytes of data files from the indicated cameras, or from all cameras if
+// none are specified.
+func (repo *RepositoryConfig) usage(cameras ...string) int64 {
+	cxn := System.getDB()
+	defer cxn.Close()
+
+	q := "select coalesce(sum(Size), 0) from Images"
+	params := []interface{}{}
+	if len(cameras) > 0 {
+		q += fmt.Sprintf(" where Camera in (%s)", placeholders(len(cameras)))
+		for _, camera := range cameras {
+			params = append(params, camera)
+		}
+	}
+
+	var usage int64
+	if err := cxn.QueryRow(q, params...).Scan(&usage); err != nil {
+		panic(err)
+	}
+	return usage
+}
+
+// evictionCandidates returns up to `limit` images pinned as `kind` but not also as MediaSaved,
+// oldest first, from the indicated cameras or from all cameras if none are specified.
+func (repo *RepositoryConfig) evictionCandidates(kind MediaKind, limit int, cameras ...string) []*Image {
+	q := `select p.Handle, p.Camera, i.Timestamp, i.HasVideo from Pins p
+					join Images i on (i.Handle=p.Handle and i.Camera=p.Camera)
+					where p.Kind=? and not exists (select 1 from Pins s where s.Handle=p.Handle and s.Camera=p.Camera and s.Kind=?)`
+	params := []interface{}{string(kind), string(MediaSaved)}
+	if len(cameras) > 0 {
+		q += fmt.Sprintf(" and p.Camera in (%s)", placeholders(len(cameras)))
+		for _, camera := range cameras {
+			params = append(params, camera)
+		}
+	}
+	q += " order by i.Timestamp asc limit ?"
+	params = append(params, limit)
+
+	return repo.queryImages(q, params...)
+}
+
+// unindexOrphans drops Images rows that no longer have any pins, i.e. whose files GC has reclaimed.
+func (repo *RepositoryConfig) unindexOrphans() {
+	System.writeDatabaseByQuery("delete from Images where not exists (select 1 from Pins p where p.Handle=Images.Handle and p.Camera=Images.Camera)")
+	System.writeDatabaseByQuery("delete from MotionScores where not exists (select 1 from Images i where i.Handle=MotionScores.Handle and i.Camera=MotionScores.Camera)")
+	System.writeDatabaseByQuery("delete from ImageLabels where not exists (select 1 from Images i where i.Handle=ImageLabels.Handle and i.Camera=ImageLabels.Camera)")
+	repo.pruneMotionEvents()
+}
+
+// pinnedHandles returns the set of all handles pinned as any kind for the indicated camera.
+func (repo *RepositoryConfig) pinnedHandles(camera string) map[string]bool {
+	return repo.queryStrings("select distinct Handle from Pins where Camera=?", camera)
+}
+
+// indexedPins returns the set of all pins recorded in the index for a camera, as "kind/handle".
+func (repo *RepositoryConfig) indexedPins(camera string) map[string]bool {
+	return repo.queryStrings("select Kind || '/' || Handle from Pins where Camera=?", camera)
+}
+
+// indexedImages returns the set of all handles recorded in the index for a camera, pinned or not.
+func (repo *RepositoryConfig) indexedImages(camera string) map[string]bool {
+	return repo.queryStrings("select Handle from Images where Camera=?", camera)
+}
+
+func (repo *RepositoryConfig) queryStrings(q string, params ...interface{}) map[string]bool {
+	cxn := System.getDB()
+	defer cxn.Close()
+
+	rows, err := cxn.Query(q, params...)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	ret := make(map[string]bool)
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			panic(err)
+		}
+		ret[s] = true
+	}
+	return ret
+}
+
+// lookupImage fetches the index entry for an image from a specific camera, pinned or not. Returns
+// nil if there is no such image.
+func (repo *RepositoryConfig) lookupImage(handle string, camera string) *Image {
+	imgs := repo.queryImages("select Handle, Camera, Timestamp, HasVideo from Images where Handle=? and Camera=?", handle, camera)
+	if len(imgs) < 1 {
+		return nil
+	}
+	return imgs[0]
+}
+
+// lookup finds a pinned image by handle. Returns nil if there is no such image.
+func (repo *RepositoryConfig) lookup(handle string) *Image {
+	q := `select i.Handle, i.Camera, i.Timestamp, i.HasVideo from Images i
+					join Cameras c on c.ID=i.Camera
+					where i.Handle=? and exists (select 1 from Pins p where p.Handle=i.Handle and p.Camera=i.Camera)
+					limit 1`
+	imgs := repo.queryImages(q, handle)
+	if len(imgs) < 1 {
+		return nil
+	}
+	return imgs[0]
+}
+
+// queryPins returns images pinned as any of the indicated kinds for a camera, newest first by
+// capture time. Zero `from` or `to` times leave that end of the range open, and a `limit` less than
+// 1 means no limit.
+func (repo *RepositoryConfig) queryPins(camera string, kinds []MediaKind, from time.Time, to time.Time, limit int) []*Image {
+	if len(kinds) < 1 {
+		return []*Image{}
+	}
+
+	params := []interface{}{camera}
+	for _, kind := range kinds {
+		params = append(params, string(kind))
+	}
+	q := fmt.Sprintf(`select p.Handle, p.Camera, i.Timestamp, i.HasVideo from Pins p
+					join Images i on (i.Handle=p.Handle and i.Camera=p.Camera)
+					where p.Camera=? and p.Kind in (%s)`, placeholders(len(kinds)))
+	if !from.IsZero() {
+		q += " and i.Timestamp >= ?"
+		params = append(params, from.UTC())
+	}
+	if !to.IsZero() {
+		q += " and i.Timestamp < ?"
+		params = append(params, to.UTC())
+	}
+	q += " order by i.Timestamp desc"
+	if limit > 0 {
+		q += " limit ?"
+		params = append(params, limit)
+	}
+
+	return repo.queryImages(q, params...)
+}
+
+// queryImages runs a query selecting (Handle, Camera, Timestamp, HasVideo) and collects the results.
+func (repo *RepositoryConfig) queryImages(q string, params ...interface{}) []*Image {
+	cxn := System.getDB()
+	defer cxn.Close()
+
+	rows, err := cxn.Query(q, params...)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	ret := []*Image{}
+	for rows.Next() {
+		img := &Image{}
+		if err := rows.Scan(&img.Handle, &img.Source, &img.Timestamp, &img.HasVideo); err != nil {
+			panic(err)
+		}
+		img.Timestamp = img.Timestamp.Local()
+		ret = append(ret, img)
+	}
+	if err := rows.Err(); err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+// indexStale indicates whether the index needs to be rebuilt from disk, i.e. whether it's empty or
+// predates the tracking of image sizes.
+func (repo *RepositoryConfig) indexStale() bool {
+	cxn := System.getDB()
+	defer cxn.Close()
+
+	total, unsized := 0, 0
+	if err := cxn.QueryRow("select count(*), count(case when Size=0 then 1 end) from Images").Scan(&total, &unsized); err != nil {
+		panic(err)
+	}
+	return total == 0 || unsized > 0
+}
+
+func placeholders(n int) string {
+	marks := make([]string, n)
+	for i := range marks {
+		marks[i] = "?"
+	}
+	return strings.Join(marks, ", ")
+}
+
+// Reindex discards the media index and rebuilds it by scanning BaseDirectory. Capture times are
+// recovered from data files' modification times (which CreateImage sets accordingly), and pin times
+// from their symlinks' modification times. Pins whose data file is missing are skipped.
+func (repo *RepositoryConfig) Reindex() {
+	TAG := "RepositoryConfig.Reindex"
+
+	cameras := System.Cameras()
+
+	cxn := System.getDB()
+	defer cxn.Close()
+
+	tx, err := cxn.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		}
+	}()
+
+	for _, q := range []string{"delete from Pins", "delete from Images"} {
+		if _, err := tx.Exec(q); err != nil {
+			panic(err)
+		}
+	}
+
+	images, pins := 0, 0
+	for _, cam := range cameras {
+		// first, every data file becomes an Images row
+		present := make(map[string]bool)
+		dataDir := repo.canonDir(filepath.Join(repo.BaseDirectory, cam.ID, MediaData))
+		prefixes, err := readDirIfExists(dataDir)
+		if err != nil {
+			panic(err)
+		}
+		for _, prefix := range prefixes {
+			if !prefix.IsDir() || len(prefix.Name()) != 3 {
+				continue
+			}
+			subdir := repo.canonDir(filepath.Join(dataDir, prefix.Name()))
+			leaves, err := readDirIfExists(subdir)
+			if err != nil {
+				panic(err)
+			}
+			videos := make(map[string][]os.FileInfo)
+			stills := make(map[string]os.FileInfo)
+			for _, leaf := range leaves {
+				chunks := strings.Split(leaf.Name(), ".")
+				if leaf.IsDir() || len(chunks) != 2 || !handleRE.MatchString(chunks[0]) {
+					continue
+				}
+				switch chunks[1] {
+				case "jpg":
+					stills[chunks[0]] = leaf
+				case "webm", "mp4":
+					videos[chunks[0]] = append(videos[chunks[0]], leaf)
+				}
+			}
+			for handle, leaf := range stills {
+				size := leaf.Size()
+				hasVideo := false
+				for _, video := range videos[handle] {
+					size += video.Size()
+					hasVideo = true
+				}
+				q := "insert into Images (Handle, Camera, Timestamp, HasVideo, Size) values (?, ?, ?, ?, ?)"
+				if _, err := tx.Exec(q, handle, cam.ID, leaf.ModTime().UTC(), hasVideo, size); err != nil {
+					panic(err)
+				}
+				present[handle] = true
+				images++
+			}
+		}
+
+		// then every symlink in a kind directory becomes a Pins row
+		for _, kind := range AllKinds {
+			entries, err := readDirIfExists(repo.dirFor(cam.ID, kind))
+			if err != nil {
+				panic(err)
+			}
+			for _, entry := range entries {
+				chunks := strings.Split(entry.Name(), ".")
+				if len(chunks) != 2 || chunks[1] != "jpg" {
+					continue
+				}
+				if !present[chunks[0]] {
+					log.Warn(TAG, fmt.Sprintf("skipping '%s' pin of missing '%s/%s'", kind, cam.ID, chunks[0]))
+					continue
+				}
+				q := "insert into Pins (Handle, Camera, Kind, Timestamp) values (?, ?, ?, ?)"
+				if _, err := tx.Exec(q, chunks[0], cam.ID, string(kind), entry.ModTime().UTC()); err != nil {
+					panic(err)
+				}
+				pins++
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+	log.Status(TAG, fmt.Sprintf("indexed %d images and %d pins", images, pins))
+}
+
+// readDirIfExists lists a directory via Lstat semantics (i.e. symlinks are not followed), treating a
+// missing directory as empty.
+func readDirIfExists(dir string) ([]os.FileInfo, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdir(0)
+}
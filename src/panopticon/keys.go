@@ -0,0 +1,163 @@
+// Copyright © 2019 Dan Morrill
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panopticon
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+ * Camera Keys
+ *
+ * Each camera authenticates its uploads with its own API key, sent as
+ * `Authorization: Bearer <key>`. The key alone identifies the camera, so a
+ * camera can't upload as any other.
+ *
+ * Keys are random, so only their SHA2-256 hashes are stored, along with a
+ * short prefix of the key so that people can tell them apart. A key is shown
+ * once, when it's issued. Rotating a camera's key issues a new one, and either
+ * revokes the old ones outright or lets them expire after a grace period so
+ * the camera can be reconfigured without dropping uploads.
+ */
+
+// cameraKeyPrefixLen is how much of a key is stored in the clear, to identify it.
+const cameraKeyPrefixLen = 8
+
+// CameraKey describes an API key issued to a camera. The key itself is not recoverable.
+type CameraKey struct {
+	Camera  string
+	Prefix  string
+	Created time.Time
+	Expires time.Time // zero if the key doesn't expire
+}
+
+func hashCameraKey(key string) string {
+	potato := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(potato[:])
+}
+
+// RotateKey issues a new API key for the camera, and returns it. Any existing keys are revoked
+// after `grace`, or immediately if it's zero.
+func (c *Camera) RotateKey(grace time.Duration) string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	key := hex.EncodeToString(b)
+
+	now := time.Now().UTC()
+	if grace > 0 {
+		expires := now.Add(grace)
+		System.writeDatabaseByQuery("update CameraKeys set Expires=? where Camera=? and (Expires is null or Expires > ?)", expires, c.ID, expires)
+	} else {
+		c.RevokeKeys()
+	}
+	System.writeDatabaseByQuery("insert into CameraKeys (Camera, Hash, Prefix, Created) values (?, ?, ?, ?)",
+		c.ID, hashCameraKey(key), key[:cameraKeyPrefixLen], now)
+
+	return key
+}
+
+// RevokeKeys revokes all of the camera's API keys, so that it can no longer upload.
+func (c *Camera) RevokeKeys() {
+	System.writeDatabaseByQuery("delete from CameraKeys where Camera=?", c.ID)
+}
+
+// RevokeKey revokes the camera's API key that begins with `prefix`, returning false if there was no
+// such key.
+func (c *Camera) RevokeKey(prefix string) bool {
+	cxn := System.getDB()
+	defer cxn.Close()
+
+	res, err := cxn.Exec("delete from CameraKeys where Camera=? and Prefix=?", c.ID, prefix)
+	if err != nil {
+		panic(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		panic(err)
+	}
+	return n > 0
+}
+
+// Keys lists the camera's API keys, including ones in their grace period but not ones that have
+// expired.
+func (c *Camera) Keys() []*CameraKey {
+	cxn := System.getDB()
+	defer cxn.Close()
+
+	rows, err := cxn.Query("select Camera, Prefix, Created, Expires from CameraKeys where Camera=? and (Expires is null or Expires > ?) order by Created",
+		c.ID, time.Now().UTC())
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	ret := []*CameraKey{}
+	for rows.Next() {
+		k := &CameraKey{}
+		var expires sql.NullTime
+		if err := rows.Scan(&k.Camera, &k.Prefix, &k.Created, &expires); err != nil {
+			panic(err)
+		}
+		k.Created = k.Created.Local()
+		if expires.Valid {
+			k.Expires = expires.Time.Local()
+		}
+		ret = append(ret, k)
+	}
+	return ret
+}
+
+// CameraForKey returns the camera to which an API key was issued, or nil if the key is unknown,
+// revoked, or expired.
+func (sys *SystemConfig) CameraForKey(key string) *Camera {
+	cxn := sys.getDB()
+	defer cxn.Close()
+
+	var camID string
+	err := cxn.QueryRow("select Camera from CameraKeys where Hash=? and (Expires is null or Expires > ?)", hashCameraKey(key), time.Now().UTC()).Scan(&camID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		panic(err)
+	}
+	return sys.GetCamera(camID)
+}
+
+// bearerToken extracts the token from a request's `Authorization: Bearer` header, if it has one.
+func bearerToken(req *http.Request) string {
+	chunks := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
+	if len(chunks) != 2 || !strings.EqualFold(chunks[0], "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(chunks[1])
+}
+
+// String renders the key's identifying details, e.g. for listings.
+func (k *CameraKey) String() string {
+	if k.Expires.IsZero() {
+		return fmt.Sprintf("%s... (issued %s)", k.Prefix, k.Created.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("%s... (issued %s, expires %s)", k.Prefix, k.Created.Format(time.RFC3339), k.Expires.Format(time.RFC3339))
+}
@@ -0,0 +1,460 @@
+// Copyright © 2019 Dan Morrill
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panopticon
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"playground/httputil"
+	"playground/log"
+)
+
+/*
+ * Live View
+ *
+ * /client/live/<camera> relays a camera's RTSP stream to the browser, either
+ * as MJPEG (multipart/x-mixed-replace, which an <img> can display directly)
+ * or, with ?format=hls, as HLS for <video> elements and native players.
+ *
+ * However many people are watching, the camera only sees one connection per
+ * format: the first viewer starts an ffmpeg process pulling from the camera,
+ * later viewers share its output, and it's stopped shortly after the last
+ * viewer leaves. An MJPEG viewer counts for as long as its connection stays
+ * open. HLS players instead fetch the playlist and segments over and over, so
+ * each such request counts as a viewer for a little while.
+ *
+ * If the camera's stream ends, so does the relay, and viewers are
+ * disconnected; the next one to arrive starts a new relay.
+ */
+
+const (
+	liveFrameRate  = 5                // MJPEG frames per second
+	liveLinger     = 5 * time.Second  // how long a relay outlives its last viewer
+	liveHLSHold    = 15 * time.Second // how long an HLS request counts as a viewer
+	liveHLSStartup = 15 * time.Second // how long to wait for ffmpeg to write the first playlist
+	liveBoundary   = "panopticon-frame"
+)
+
+var liveFileRE = regexp.MustCompile(`^(index\.m3u8|seg[0-9]+\.ts)$`)
+
+// liveRelay is a single ffmpeg process pulling a camera's stream, shared among its viewers.
+type liveRelay struct {
+	key    string // the camera, stream URL, and format, so that a changed URL gets a new relay
+	name   string // the camera and format, for logging without the URL's credentials
+	refs   int
+	frames map[chan []byte]bool // MJPEG viewers, each of which is sent every frame it can keep up with
+	dir    string               // where ffmpeg writes HLS output
+	stop   chan struct{}
+	closed bool
+	idle   *time.Timer
+}
+
+type relaySet struct {
+	lock   sync.Mutex
+	relays map[string]*liveRelay
+}
+
+var live = &relaySet{relays: make(map[string]*liveRelay)}
+
+// acquireRelay returns the relay of the camera's stream in the indicated format ("mjpeg" or "hls"),
+// starting it if necessary. The caller must release it when done.
+func acquireRelay(cam *Camera, format string) (*liveRelay, error) {
+	live.lock.Lock()
+	defer live.lock.Unlock()
+
+	name := fmt.Sprintf("%s/%s", cam.ID, format)
+	key := fmt.Sprintf("%s %s %s", cam.ID, cam.RTSPURL, format)
+	r, ok := live.relays[key]
+	if !ok {
+		r = &liveRelay{key: key, name: name, frames: make(map[chan []byte]bool), stop: make(chan struct{})}
+
+		args := append(streamInputArgs(cam.RTSPURL), "-an")
+		if format == "hls" {
+			var err error
+			if r.dir, err = ioutil.TempDir("", fmt.Sprintf("panopticon-live-%s-", cam.ID)); err != nil {
+				return nil, err
+			}
+			args = append(args, "-c:v", "copy", "-f", "hls", "-hls_time", "2", "-hls_list_size", "6", "-hls_flags", "delete_segments",
+				"-hls_segment_filename", filepath.Join(r.dir, "seg%d.ts"), filepath.Join(r.dir, "index.m3u8"))
+		} else {
+			args = append(args, "-vf", fmt.Sprintf("fps=%d", liveFrameRate), "-q:v", "5", "-f", "mjpeg", "pipe:1")
+		}
+
+		cmd := exec.Command("ffmpeg", args...)
+		stdout, err := cmd.StdoutPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			if r.dir != "" {
+				os.RemoveAll(r.dir)
+			}
+			return nil, err
+		}
+		log.Status("acquireRelay", fmt.Sprintf("started %s relay for '%s' from %s", format, cam.ID, redactURL(cam.RTSPURL)))
+
+		live.relays[key] = r
+		go r.run(cmd, stdout, format == "mjpeg")
+	}
+
+	r.refs++
+	if r.idle != nil {
+		r.idle.Stop()
+		r.idle = nil
+	}
+	return r, nil
+}
+
+// release gives up a reference to the relay. Once nobody has one for liveLinger, it's stopped.
+func (r *liveRelay) release() {
+	live.lock.Lock()
+	defer live.lock.Unlock()
+
+	if r.refs--; r.refs > 0 || r.closed {
+		return
+	}
+	r.idle = time.AfterFunc(liveLinger, func() {
+		live.lock.Lock()
+		defer live.lock.Unlock()
+		if r.refs == 0 {
+			r.closeLocked()
+		}
+	})
+}
+
+// closeLocked stops the relay and disconnects its MJPEG viewers. The caller must hold live.lock.
+func (r *liveRelay) closeLocked() {
+	if r.closed {
+		return
+	}
+	r.closed = true
+	if live.relays[r.key] == r {
+		delete(live.relays, r.key)
+	}
+	close(r.stop)
+	for ch := range r.frames {
+		close(ch)
+	}
+	r.frames = make(map[chan []byte]bool)
+}
+
+// alive indicates whether the relay is still running.
+func (r *liveRelay) alive() bool {
+	live.lock.Lock()
+	defer live.lock.Unlock()
+	return !r.closed
+}
+
+// subscribe returns a channel on which the relay's MJPEG frames will be sent, which is closed if the
+// relay stops.
+func (r *liveRelay) subscribe() chan []byte {
+	live.lock.Lock()
+	defer live.lock.Unlock()
+
+	ch := make(chan []byte, 1)
+	if r.closed {
+		close(ch)
+	} else {
+		r.frames[ch] = true
+	}
+	return ch
+}
+
+func (r *liveRelay) unsubscribe(ch chan []byte) {
+	live.lock.Lock()
+	defer live.lock.Unlock()
+
+	if r.frames[ch] {
+		delete(r.frames, ch)
+		close(ch)
+	}
+}
+
+// broadcast sends a frame to every MJPEG viewer that's ready for one; those still busy with the last
+// frame miss this one, so that a slow viewer can't hold up the others.
+func (r *liveRelay) broadcast(frame []byte) {
+	live.lock.Lock()
+	defer live.lock.Unlock()
+
+	for ch := range r.frames {
+		select {
+		case ch <- frame:
+		default:
+		}
+	}
+}
+
+// run waits for the relay's ffmpeg process to exit, or kills it when the relay is stopped. For MJPEG,
+// it also splits ffmpeg's output into frames for the viewers.
+func (r *liveRelay) run(cmd *exec.Cmd, stdout io.ReadCloser, mjpeg bool) {
+	TAG := "liveRelay.run"
+
+	done := make(chan error, 1)
+	go func() {
+		if mjpeg {
+			br := bufio.NewReaderSize(stdout, 64*1024)
+			for {
+				frame, err := readJPEG(br)
+				if err != nil {
+					cmd.Process.Kill() // no-op if it had already exited, which is the usual reason
+					break
+				}
+				r.broadcast(frame)
+			}
+		} else {
+			io.Copy(ioutil.Discard, stdout)
+		}
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		log.Warn(TAG, fmt.Sprintf("upstream for relay '%s' ended", r.name), err)
+	case <-r.stop:
+		cmd.Process.Kill()
+		<-done
+		log.Status(TAG, fmt.Sprintf("stopped relay '%s'", r.name))
+	}
+
+	live.lock.Lock()
+	r.closeLocked()
+	live.lock.Unlock()
+
+	if r.dir != "" {
+		if err := os.RemoveAll(r.dir); err != nil {
+			log.Error(TAG, fmt.Sprintf("failed to remove '%s'", r.dir), err)
+		}
+	}
+}
+
+// readJPEG reads the next image from a stream of concatenated JPEGs, such as ffmpeg's mjpeg muxer
+// writes. Marker segments are skipped by their lengths; within the entropy-coded data following SOS,
+// 0xFF is always followed by 0x00 or a restart marker, so anything else is the next marker.
+func readJPEG(r *bufio.Reader) ([]byte, error) {
+	// skip anything preceding the SOI marker
+	var prev byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if prev == 0xFF && b == 0xD8 {
+			break
+		}
+		prev = b
+	}
+
+	buf := []byte{0xFF, 0xD8}
+	marker, err := nextJPEGMarker(r)
+	for {
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, 0xFF, marker)
+		if marker == 0xD9 { // EOI
+			return buf, nil
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) { // no payload
+			marker, err = nextJPEGMarker(r)
+			continue
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return nil, err
+		}
+		n := int(length[0])<<8 | int(length[1])
+		if n < 2 {
+			return nil, fmt.Errorf("bad JPEG segment length %d", n)
+		}
+		payload := make([]byte, n-2)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+		buf = append(append(buf, length[:]...), payload...)
+
+		if marker != 0xDA { // SOS
+			marker, err = nextJPEGMarker(r)
+			continue
+		}
+		for {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if b != 0xFF {
+				buf = append(buf, b)
+				continue
+			}
+			m, err := r.ReadByte()
+			for err == nil && m == 0xFF { // fill bytes
+				m, err = r.ReadByte()
+			}
+			if err != nil {
+				return nil, err
+			}
+			if m == 0x00 || (m >= 0xD0 && m <= 0xD7) {
+				buf = append(buf, 0xFF, m)
+				continue
+			}
+			marker = m
+			break
+		}
+	}
+}
+
+// nextJPEGMarker reads a marker, returning the byte identifying it.
+func nextJPEGMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xFF {
+		return 0, fmt.Errorf("expected JPEG marker, found 0x%02x", b)
+	}
+	for b == 0xFF {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+// LiveHandler handles /client/live/<camera>, which relays the camera's stream as MJPEG. With
+// ?format=hls it instead redirects to /client/live/<camera>/index.m3u8, the HLS playlist, which (along
+// with the segments it lists) is also served from here.
+func LiveHandler(writer http.ResponseWriter, req *http.Request) {
+	TAG := "panopticon.LiveHandler"
+	badReq := httputil.NewJSONAssertable(writer, TAG, http.StatusBadRequest, clientError)
+	notFound := httputil.NewJSONAssertable(writer, TAG, http.StatusNotFound, noSuchCamera)
+	noStream := httputil.NewJSONAssertable(writer, TAG, http.StatusNotFound, noLiveStream)
+
+	camID := httputil.ExtractSegment(req.URL.Path, 3)
+	cam := System.GetCamera(camID)
+	notFound.Assert(cam != nil, "live view requested for unknown camera '%s'", camID)
+	u := userFor(req)
+	notFound.Assert(!cam.Private || u.Privileged, "attempt by '%s' to view private '%s'", u.Email, cam.ID)
+	noStream.Assert(cam.RTSPURL != "", "live view requested for '%s', which has no stream", cam.ID)
+
+	file := httputil.ExtractSegment(req.URL.Path, 4)
+	if file != "" {
+		badReq.Assert(liveFileRE.MatchString(file), "bad live file '%s' requested for '%s'", file, cam.ID)
+		serveHLS(writer, req, cam, file)
+		return
+	}
+	switch format := req.URL.Query().Get("format"); format {
+	case "", "mjpeg":
+		serveMJPEG(writer, req, cam)
+	case "hls":
+		http.Redirect(writer, req, fmt.Sprintf("/client/live/%s/index.m3u8", cam.ID), http.StatusFound)
+	default:
+		badReq.Assert(false, "unknown live format '%s' requested for '%s'", format, cam.ID)
+	}
+}
+
+func serveMJPEG(writer http.ResponseWriter, req *http.Request, cam *Camera) {
+	TAG := "panopticon.serveMJPEG"
+	unavailable := httputil.NewJSONAssertable(writer, TAG, http.StatusServiceUnavailable, streamUnavailable)
+
+	r, err := acquireRelay(cam, "mjpeg")
+	unavailable.Assert(err == nil, "failed to start relay for '%s' (%s)", cam.ID, err)
+	defer r.release()
+	frames := r.subscribe()
+	defer r.unsubscribe(frames)
+
+	// the response lasts as long as the viewer keeps watching, so it can't be subject to the server's
+	// usual write timeout
+	rc := http.NewResponseController(writer)
+	rc.SetWriteDeadline(time.Time{})
+
+	writer.Header().Set("Content-Type", fmt.Sprintf("multipart/x-mixed-replace; boundary=%s", liveBoundary))
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(http.StatusOK)
+	for {
+		select {
+		case frame, ok := <-frames:
+			if !ok {
+				return
+			}
+			if _, err := fmt.Fprintf(writer, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", liveBoundary, len(frame)); err != nil {
+				return
+			}
+			if _, err := writer.Write(frame); err != nil {
+				return
+			}
+			if _, err := writer.Write([]byte("\r\n")); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+func serveHLS(writer http.ResponseWriter, req *http.Request, cam *Camera, file string) {
+	TAG := "panopticon.serveHLS"
+	notFound := httputil.NewJSONAssertable(writer, TAG, http.StatusNotFound, missingImage)
+	unavailable := httputil.NewJSONAssertable(writer, TAG, http.StatusServiceUnavailable, streamUnavailable)
+
+	r, err := acquireRelay(cam, "hls")
+	unavailable.Assert(err == nil, "failed to start relay for '%s' (%s)", cam.ID, err)
+	time.AfterFunc(liveHLSHold, r.release)
+
+	// the first viewer has to wait for ffmpeg to connect and write a segment
+	path := filepath.Join(r.dir, file)
+	if file == "index.m3u8" {
+		deadline := time.Now().Add(liveHLSStartup)
+		for {
+			if _, err := os.Stat(path); err == nil {
+				break
+			}
+			unavailable.Assert(r.alive() && time.Now().Before(deadline), "no playlist from relay for '%s'", cam.ID)
+			select {
+			case <-req.Context().Done():
+				return
+			case <-time.After(250 * time.Millisecond):
+			}
+		}
+	}
+
+	f, err := os.Open(path)
+	notFound.Assert(err == nil, "live file '%s' unavailable for '%s'", file, cam.ID)
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		panic(err)
+	}
+
+	if file == "index.m3u8" {
+		writer.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	} else {
+		writer.Header().Set("Content-Type", "video/mp2t")
+	}
+	writer.Header().Set("Cache-Control", "no-store")
+	http.ServeContent(writer, req, "", fi.ModTime(), f)
+}
@@ -1,10 +1,13 @@
 package messages
 
+import "time"
+
 type Camera struct {
 	// core information about the camera
 	Name        string
 	ID          string
 	AspectRatio string
+	HasLive     bool
 
 	// current state information
 	Sleeping  bool
@@ -35,6 +38,30 @@ type ImageMeta struct {
 	Time     string `json:",omitempty"`
 	Date     string `json:",omitempty"`
 	HasVideo bool
+
+	// fraction of the image that changed, if the server judged it to show motion
+	MotionScore float64 `json:",omitempty"`
+
+	// what the image classifier (if any) recognized in the image
+	Labels []*Label `json:",omitempty"`
+}
+
+type Label struct {
+	Name       string
+	Confidence float64
+}
+
+// ClassifyRequest is what the server sends to an external classifier command for each image.
+type ClassifyRequest struct {
+	Camera    string
+	Handle    string
+	Timestamp time.Time
+	JPEG      []byte
+}
+
+// ClassifyResult is what an external classifier command replies with.
+type ClassifyResult struct {
+	Labels []*Label
 }
 
 type ImageList struct {
@@ -42,3 +69,88 @@ type ImageList struct {
 	Total  int
 	Images []*ImageMeta
 }
+
+// MotionEvent is a burst of motion images from a camera.
+type MotionEvent struct {
+	ID         int64
+	Start      time.Time
+	End        time.Time
+	Time       string // Start, formatted as in ImageMeta
+	Date       string
+	Frames     int
+	Still      *ImageMeta `json:",omitempty"`
+	Reviewed   bool
+	ReviewedBy string `json:",omitempty"`
+	Images     []*ImageMeta
+}
+
+type MotionEventList struct {
+	Camera string
+	Total  int
+	Events []*MotionEvent
+}
+
+type Enrollment struct {
+	ServiceURL string
+	Token      string
+}
+
+type EnrollmentResult struct {
+	Camera            string
+	Name              string
+	Key               string
+	ServiceURL        string
+	CaptureTimeHeader string // for single uploads; batch uploads always use BatchCaptureTimeHeader
+
+	// how the camera should capture, unless configured otherwise locally; zero values leave it to the
+	// camera
+	CaptureMode       string // "collected" or "motion"
+	CaptureInterval   int    // seconds between captures
+	MotionSensitivity int    // 1-100
+}
+
+type Uptime struct {
+	Camera    string
+	From      time.Time
+	To        time.Time
+	Uptime    float64
+	LastImage time.Time
+	Offline   bool
+	Message   string
+	Gaps      []*Gap
+}
+
+type Gap struct {
+	Start   time.Time
+	End     time.Time
+	Minutes int
+}
+
+type Event struct {
+	Type     string
+	Camera   string
+	Kind     string     `json:",omitempty"`
+	Image    *ImageMeta `json:",omitempty"`
+	Sleeping bool
+	Offline  bool
+	Message  string `json:",omitempty"`
+}
+
+type BatchResult struct {
+	Camera string
+	Items  []*BatchItem
+}
+
+// BatchCaptureTimeHeader is the header of each part of a batch upload that carries the item's capture
+// time (RFC 3339, or seconds since the Unix epoch.) Unlike the header for single uploads, its name
+// isn't configurable.
+const BatchCaptureTimeHeader = "Capture-Time"
+
+type BatchItem struct {
+	ID        string
+	Hash      string
+	Status    string
+	Handle    string `json:",omitempty"`
+	Timestamp string `json:",omitempty"`
+	Error     string `json:",omitempty"`
+}
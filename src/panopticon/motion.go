@@ -0,0 +1,192 @@
+// Copyright © 2019 Dan Morrill
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panopticon
+
+import (
+	"database/sql"
+	"fmt"
+	"image"
+	"sync"
+	"time"
+
+	"playground/log"
+)
+
+/*
+ * Motion Detection
+ *
+ * Cameras that only deliver periodic images can still fill the Motion strip:
+ * if a camera has a MotionSensitivity, each collected image from it is compared
+ * with the one before, and if enough of the picture changed, the image is also
+ * pinned as MediaMotion, and its score (the fraction of the picture that
+ * changed) is recorded.
+ *
+ * Images are compared as small grayscale thumbnails, each adjusted for its
+ * overall brightness so that, say, a cloud passing over the sun doesn't count.
+ * The previous thumbnail of each camera is kept only in memory, so the first
+ * image after a restart -- or after a long enough gap -- is never motion.
+ * Only changes within the camera's zones count, if it has any (see zones.go.)
+ */
+
+const (
+	motionGridWidth  = 64
+	motionGridHeight = 36
+	motionPixelDelta = 24               // how much (of 255) a thumbnail pixel must change to count as changed
+	motionMaxGap     = 10 * time.Minute // images further apart than this aren't compared
+)
+
+type motionFrame struct {
+	thumb    []uint8
+	captured time.Time
+}
+
+var motionFrames = struct {
+	lock   sync.Mutex
+	frames map[string]*motionFrame
+}{frames: map[string]*motionFrame{}}
+
+// motionCheck is the result of comparing an image with the previous one from its camera.
+type motionCheck struct {
+	score  float64 // fraction of the picture that changed, counting only the camera's zones if it has any
+	masked bool    // whether the camera has zones
+}
+
+// observeMotion compares a new image from the camera (`decoded` being its pixels) with the previous
+// one, and keeps it to compare the next one with unless it's older. Returns nil if there was nothing
+// recent enough to compare with, or if the camera neither analyzes motion nor has zones, in which
+// case it isn't kept.
+func observeMotion(cam *Camera, decoded image.Image, captured time.Time) *motionCheck {
+	mask := motionMask(cam.MotionZones())
+	if cam.MotionSensitivity <= 0 && mask == nil {
+		return nil
+	}
+	if captured.IsZero() {
+		captured = time.Now()
+	}
+
+	cur := &motionFrame{motionThumbnail(decoded), captured}
+	motionFrames.lock.Lock()
+	prev := motionFrames.frames[cam.ID]
+	// an older image (e.g. from a batch catching up) mustn't displace a newer one, or live images
+	// that follow would be compared with it and found too far apart
+	if prev == nil || !cur.captured.Before(prev.captured) {
+		motionFrames.frames[cam.ID] = cur
+	}
+	motionFrames.lock.Unlock()
+
+	if prev == nil || cur.captured.Before(prev.captured) || cur.captured.Sub(prev.captured) > motionMaxGap {
+		return nil
+	}
+	return &motionCheck{score: motionScore(changedCells(prev.thumb, cur.thumb), mask), masked: mask != nil}
+}
+
+// outsideZones indicates whether a motion upload should be dropped because nothing changed within
+// the camera's zones.
+func (check *motionCheck) outsideZones() bool {
+	return check != nil && check.masked && check.score < motionThreshold(100)
+}
+
+// analyzeMotion pins a newly-stored collected image as motion if the camera analyzes motion, and
+// enough of the image changed.
+func analyzeMotion(cam *Camera, img *Image, check *motionCheck) {
+	TAG := "analyzeMotion"
+	if cam.MotionSensitivity <= 0 || check == nil || check.score < motionThreshold(cam.MotionSensitivity) {
+		return
+	}
+
+	log.Debug(TAG, fmt.Sprintf("motion in '%s' from '%s' (score %.3f)", img.Handle, cam.ID, check.score))
+	System.writeDatabaseByQuery("insert into MotionScores (Handle, Camera, Score) values (?, ?, ?) on conflict (Handle, Camera) do update set Score=excluded.Score",
+		img.Handle, img.Source, check.score)
+	if img.Pin(MediaMotion) {
+		groupMotion(img)
+	}
+}
+
+// motionThreshold returns the score at or above which a camera with the indicated sensitivity has
+// seen motion: from a tenth of the picture at sensitivity 1, to a thousandth at 100.
+func motionThreshold(sensitivity int) float64 {
+	return float64(101-sensitivity) / 1000
+}
+
+// motionThumbnail samples an image down to a motionGridWidth x motionGridHeight grayscale thumbnail.
+func motionThumbnail(img image.Image) []uint8 {
+	bounds := img.Bounds()
+	thumb := make([]uint8, 0, motionGridWidth*motionGridHeight)
+	for y := 0; y < motionGridHeight; y++ {
+		for x := 0; x < motionGridWidth; x++ {
+			px := bounds.Min.X + (2*x+1)*bounds.Dx()/(2*motionGridWidth)
+			py := bounds.Min.Y + (2*y+1)*bounds.Dy()/(2*motionGridHeight)
+			r, g, b, _ := img.At(px, py).RGBA()
+			thumb = append(thumb, uint8((299*r+587*g+114*b)/1000>>8))
+		}
+	}
+	return thumb
+}
+
+// changedCells compares two thumbnails, after adjusting each for its average brightness, and reports
+// which of their pixels changed noticeably.
+func changedCells(prev []uint8, cur []uint8) []bool {
+	changed := make([]bool, len(cur))
+	if len(prev) != len(cur) || len(cur) == 0 {
+		return changed
+	}
+
+	var prevSum, curSum int
+	for i := range cur {
+		prevSum += int(prev[i])
+		curSum += int(cur[i])
+	}
+	shift := (curSum - prevSum) / len(cur)
+	for i := range cur {
+		d := int(cur[i]) - int(prev[i]) - shift
+		changed[i] = d > motionPixelDelta || d < -motionPixelDelta
+	}
+	return changed
+}
+
+// motionScore returns the fraction of cells that changed, out of those in `mask` if it isn't nil.
+func motionScore(changed []bool, mask []bool) float64 {
+	n, total := 0, 0
+	for i, c := range changed {
+		if mask != nil && (i >= len(mask) || !mask[i]) {
+			continue
+		}
+		total++
+		if c {
+			n++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+// MotionScore returns the fraction of the image that had changed when it was judged to show motion,
+// or zero if it wasn't analyzed (or was uploaded as motion by the camera itself.)
+func (img *Image) MotionScore() float64 {
+	cxn := System.getDB()
+	defer cxn.Close()
+
+	var score float64
+	err := cxn.QueryRow("select Score from MotionScores where Handle=? and Camera=?", img.Handle, img.Source).Scan(&score)
+	if err == sql.ErrNoRows {
+		return 0
+	}
+	if err != nil {
+		panic(err)
+	}
+	return score
+}
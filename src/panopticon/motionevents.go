@@ -0,0 +1,468 @@
+// Copyright © 2019 Dan Morrill
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panopticon
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"panopticon/messages"
+
+	"playground/httputil"
+	"playground/log"
+)
+
+/*
+ * Motion Events
+ *
+ * One person walking past a camera can produce a dozen motion images, so
+ * motion images are grouped into events: each newly-pinned motion image joins
+ * whichever event from its camera it was captured within motionEventGap of,
+ * or else starts a new one. Images can arrive out of order (e.g. from a batch
+ * upload), so an image that bridges two events merges them.
+ *
+ * Each event has a representative still, which is the frame with the highest
+ * motion score if the server detected the motion itself, and otherwise the
+ * middle frame. Events can be marked reviewed, but a new frame arriving
+ * reopens an event for review. Events fade away along with their images.
+ */
+
+const motionEventGap = 2 * time.Minute
+
+// motionEventsPer is how many events /client/events/<camera> lists at a time, unless asked for fewer.
+const motionEventsPer = 50
+
+// MotionEvent is a burst of motion images from a camera.
+type MotionEvent struct {
+	ID         int64
+	Camera     string
+	Start      time.Time
+	End        time.Time
+	Frames     int
+	Still      string // handle of the representative image
+	Reviewed   bool
+	ReviewedBy string
+}
+
+// motionEventLock serializes grouping, so that concurrent uploads from a camera can't start separate
+// events for the same burst.
+var motionEventLock sync.Mutex
+
+// groupMotion adds a newly-pinned motion image to the event it belongs to, starting one if needed.
+func groupMotion(img *Image) {
+	TAG := "groupMotion"
+
+	motionEventLock.Lock()
+	defer motionEventLock.Unlock()
+
+	cxn := System.getDB()
+	defer cxn.Close()
+
+	tx, err := cxn.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		}
+	}()
+
+	t := img.Timestamp.UTC()
+	rows, err := tx.Query("select ID, Start, End from MotionEvents where Camera=? and Start <= ? and End >= ? order by ID",
+		img.Source, t.Add(motionEventGap), t.Add(-motionEventGap))
+	if err != nil {
+		panic(err)
+	}
+	events := []*MotionEvent{}
+	for rows.Next() {
+		ev := &MotionEvent{}
+		if err := rows.Scan(&ev.ID, &ev.Start, &ev.End); err != nil {
+			rows.Close()
+			panic(err)
+		}
+		events = append(events, ev)
+	}
+	rows.Close()
+
+	var ev *MotionEvent
+	if len(events) == 0 {
+		res, err := tx.Exec("insert into MotionEvents (Camera, Start, End) values (?, ?, ?)", img.Source, t, t)
+		if err != nil {
+			panic(err)
+		}
+		ev = &MotionEvent{Start: t, End: t}
+		if ev.ID, err = res.LastInsertId(); err != nil {
+			panic(err)
+		}
+		log.Debug(TAG, fmt.Sprintf("new motion event %d from '%s'", ev.ID, img.Source))
+	} else {
+		ev = events[0]
+		for _, other := range events[1:] {
+			if _, err := tx.Exec("update MotionEventFrames set Event=? where Event=?", ev.ID, other.ID); err != nil {
+				panic(err)
+			}
+			if _, err := tx.Exec("delete from MotionEvents where ID=?", other.ID); err != nil {
+				panic(err)
+			}
+			ev.extend(other.Start)
+			ev.extend(other.End)
+			log.Debug(TAG, fmt.Sprintf("merged motion event %d into %d", other.ID, ev.ID))
+		}
+	}
+	ev.extend(t)
+
+	if _, err := tx.Exec("insert or ignore into MotionEventFrames (Event, Handle, Camera) values (?, ?, ?)", ev.ID, img.Handle, img.Source); err != nil {
+		panic(err)
+	}
+	if _, err := tx.Exec("update MotionEvents set Start=?, End=?, Reviewed=0, ReviewedBy='' where ID=?", ev.Start.UTC(), ev.End.UTC(), ev.ID); err != nil {
+		panic(err)
+	}
+	updateMotionEvent(tx, ev.ID)
+
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+}
+
+// extend widens the event's span to include `t`.
+func (ev *MotionEvent) extend(t time.Time) {
+	if t.Before(ev.Start) {
+		ev.Start = t
+	}
+	if t.After(ev.End) {
+		ev.End = t
+	}
+}
+
+// updateMotionEvent recounts an event's frames, and picks its representative still.
+func updateMotionEvent(tx *sql.Tx, id int64) {
+	rows, err := tx.Query(`select f.Handle, coalesce(s.Score, 0) from MotionEventFrames f
+		join Images i on i.Handle=f.Handle and i.Camera=f.Camera
+		left join MotionScores s on s.Handle=f.Handle and s.Camera=f.Camera
+		where f.Event=? order by i.Timestamp`, id)
+	if err != nil {
+		panic(err)
+	}
+	handles := []string{}
+	best, bestScore := "", 0.0
+	for rows.Next() {
+		var handle string
+		var score float64
+		if err := rows.Scan(&handle, &score); err != nil {
+			rows.Close()
+			panic(err)
+		}
+		handles = append(handles, handle)
+		if score > bestScore {
+			best, bestScore = handle, score
+		}
+	}
+	rows.Close()
+
+	if best == "" && len(handles) > 0 {
+		best = handles[len(handles)/2]
+	}
+	if _, err := tx.Exec("update MotionEvents set Frames=?, Still=? where ID=?", len(handles), best, id); err != nil {
+		panic(err)
+	}
+}
+
+// pruneMotionEvents drops events whose images have all been purged, and updates those that lost some.
+func (repo *RepositoryConfig) pruneMotionEvents() {
+	motionEventLock.Lock()
+	defer motionEventLock.Unlock()
+
+	System.writeDatabaseByQuery("delete from MotionEventFrames where not exists (select 1 from Images i where i.Handle=MotionEventFrames.Handle and i.Camera=MotionEventFrames.Camera)")
+	System.writeDatabaseByQuery("delete from MotionEvents where not exists (select 1 from MotionEventFrames f where f.Event=MotionEvents.ID)")
+
+	cxn := System.getDB()
+	defer cxn.Close()
+
+	rows, err := cxn.Query("select ID from MotionEvents e where Frames <> (select count(*) from MotionEventFrames f where f.Event=e.ID)")
+	if err != nil {
+		panic(err)
+	}
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			panic(err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if len(ids) == 0 {
+		return
+	}
+
+	tx, err := cxn.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		}
+	}()
+	for _, id := range ids {
+		updateMotionEvent(tx, id)
+	}
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+}
+
+// MotionEvents returns the camera's events, newest first, skipping the first `skip` and returning at
+// most `per` (or all, if `per` isn't positive), and also the total number there are. If `unreviewed`
+// is set, only events that haven't been reviewed are included.
+func (c *Camera) MotionEvents(skip int, per int, unreviewed bool) ([]*MotionEvent, int) {
+	cxn := System.getDB()
+	defer cxn.Close()
+
+	where := "Camera=?"
+	if unreviewed {
+		where += " and Reviewed=0"
+	}
+
+	var total int
+	if err := cxn.QueryRow(fmt.Sprintf("select count(*) from MotionEvents where %s", where), c.ID).Scan(&total); err != nil {
+		panic(err)
+	}
+
+	if per <= 0 {
+		per = -1 // i.e. no limit, to SQLite
+	}
+	q := fmt.Sprintf("select ID, Camera, Start, End, Frames, Still, Reviewed, ReviewedBy from MotionEvents where %s order by Start desc limit ? offset ?", where)
+	rows, err := cxn.Query(q, c.ID, per, skip)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	ret := []*MotionEvent{}
+	for rows.Next() {
+		ret = append(ret, scanMotionEvent(rows))
+	}
+	return ret, total
+}
+
+// MotionEvent returns the camera's event with the indicated ID, or nil if there's no such event.
+func (c *Camera) MotionEvent(id int64) *MotionEvent {
+	cxn := System.getDB()
+	defer cxn.Close()
+
+	rows, err := cxn.Query("select ID, Camera, Start, End, Frames, Still, Reviewed, ReviewedBy from MotionEvents where Camera=? and ID=?", c.ID, id)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil
+	}
+	return scanMotionEvent(rows)
+}
+
+func scanMotionEvent(rows *sql.Rows) *MotionEvent {
+	ev := &MotionEvent{}
+	var reviewed int
+	if err := rows.Scan(&ev.ID, &ev.Camera, &ev.Start, &ev.End, &ev.Frames, &ev.Still, &reviewed, &ev.ReviewedBy); err != nil {
+		panic(err)
+	}
+	ev.Start = ev.Start.Local()
+	ev.End = ev.End.Local()
+	ev.Reviewed = reviewed != 0
+	return ev
+}
+
+// Images returns the event's frames, oldest first.
+func (ev *MotionEvent) Images() []*Image {
+	return Repository.queryImages(`select i.Handle, i.Camera, i.Timestamp, i.HasVideo from MotionEventFrames f
+		join Images i on i.Handle=f.Handle and i.Camera=f.Camera where f.Event=? order by i.Timestamp`, ev.ID)
+}
+
+// framesOf returns the frames of each of the indicated events, oldest first, by event ID.
+func framesOf(events []*MotionEvent) map[int64][]*Image {
+	ret := map[int64][]*Image{}
+	if len(events) == 0 {
+		return ret
+	}
+
+	cxn := System.getDB()
+	defer cxn.Close()
+
+	params := []interface{}{}
+	for _, ev := range events {
+		params = append(params, ev.ID)
+	}
+	q := fmt.Sprintf(`select f.Event, i.Handle, i.Camera, i.Timestamp, i.HasVideo from MotionEventFrames f
+		join Images i on i.Handle=f.Handle and i.Camera=f.Camera where f.Event in (%s) order by i.Timestamp`, placeholders(len(events)))
+	rows, err := cxn.Query(q, params...)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		img := &Image{}
+		if err := rows.Scan(&id, &img.Handle, &img.Source, &img.Timestamp, &img.HasVideo); err != nil {
+			panic(err)
+		}
+		img.Timestamp = img.Timestamp.Local()
+		ret[id] = append(ret[id], img)
+	}
+	if err := rows.Err(); err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+// Review marks the event as reviewed by the indicated user, or as not reviewed if `email` is empty.
+func (ev *MotionEvent) Review(email string) {
+	reviewed := 0
+	if email != "" {
+		reviewed = 1
+	}
+	System.writeDatabaseByQuery("update MotionEvents set Reviewed=?, ReviewedBy=? where ID=?", reviewed, email, ev.ID)
+	ev.Reviewed, ev.ReviewedBy = email != "", email
+}
+
+// clearMotionEvents forgets the camera's events, e.g. when it's deleted.
+func (c *Camera) clearMotionEvents() {
+	System.writeDatabaseByQuery("delete from MotionEventFrames where Camera=?", c.ID)
+	System.writeDatabaseByQuery("delete from MotionEvents where Camera=?", c.ID)
+}
+
+// MotionEventsHandler handles /client/events/<camera>, which lists the camera's motion events with
+// their frames, newest first, paged like /client/images (at most motionEventsPer at a time) and
+// optionally only those not yet reviewed (`?unreviewed=true`). A PUT to /client/events/<camera>/<id>
+// with {"Reviewed": true|false} marks an event as reviewed (or not) by the current user.
+func MotionEventsHandler(writer http.ResponseWriter, req *http.Request) {
+	TAG := "panopticon.MotionEventsHandler"
+	badReq := httputil.NewJSONAssertable(writer, TAG, http.StatusBadRequest, clientError)
+	notFound := httputil.NewJSONAssertable(writer, TAG, http.StatusNotFound, noSuchCamera)
+	noEvent := httputil.NewJSONAssertable(writer, TAG, http.StatusNotFound, noSuchEvent)
+	notAllowed := httputil.NewJSONAssertable(writer, TAG, http.StatusMethodNotAllowed, badMethod)
+	ise := httputil.NewJSONAssertable(writer, TAG, http.StatusInternalServerError, internalError)
+
+	camID := httputil.ExtractSegment(req.URL.Path, 3)
+	cam := System.GetCamera(camID)
+	notFound.Assert(cam != nil, "motion events requested for unknown camera '%s'", camID)
+	u := userFor(req)
+	notFound.Assert(!cam.Private || u.Privileged, "attempt by '%s' to access private '%s'", u.Email, cam.ID)
+
+	loc := cam.Location()
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	if raw := httputil.ExtractSegment(req.URL.Path, 4); raw != "" {
+		id, err := strconv.ParseInt(raw, 10, 64)
+		badReq.Assert(err == nil, "unparseable motion event ID '%s'", raw)
+		ev := cam.MotionEvent(id)
+		noEvent.Assert(ev != nil, "unknown motion event %d for '%s'", id, cam.ID)
+
+		switch req.Method {
+		case "GET":
+		case "PUT":
+			review := struct{ Reviewed bool }{}
+			err := json.NewDecoder(req.Body).Decode(&review)
+			badReq.Assert(err == nil, "malformed review of motion event %d (%s)", id, err)
+			if review.Reviewed {
+				ev.Review(u.Email)
+			} else {
+				ev.Review("")
+			}
+			log.Status(TAG, fmt.Sprintf("'%s' marked motion event %d from '%s' reviewed=%t", u.Email, id, cam.ID, review.Reviewed))
+		default:
+			notAllowed.Assert(false, "unsupported method %s on motion event", req.Method)
+		}
+		httputil.SendJSON(writer, http.StatusOK, &APIResponse{Artifact: ev.meta(cam, loc, ev.Images())})
+		return
+	}
+
+	notAllowed.Assert(req.Method == "GET", "unsupported method %s on motion event list", req.Method)
+
+	err := req.ParseForm()
+	ise.Assert(err == nil, "error parsing request form (%s)", err)
+
+	skip, per := 0, motionEventsPer
+	if raw := req.Form.Get("skip"); raw != "" {
+		skip, err = strconv.Atoi(raw)
+		badReq.Assert(err == nil && skip >= 0, "unparseable skip value '%s'", raw)
+	}
+	if raw := req.Form.Get("per"); raw != "" {
+		per, err = strconv.Atoi(raw)
+		badReq.Assert(err == nil, "unparseable per value '%s'", raw)
+		if per <= 0 || per > motionEventsPer {
+			per = motionEventsPer
+		}
+	}
+	unreviewed := false
+	if raw := req.Form.Get("unreviewed"); raw != "" {
+		unreviewed, err = strconv.ParseBool(raw)
+		badReq.Assert(err == nil, "unparseable unreviewed value '%s'", raw)
+	}
+
+	events, total := cam.MotionEvents(skip, per, unreviewed)
+	frames := framesOf(events)
+	res := &messages.MotionEventList{Camera: cam.Name, Total: total, Events: []*messages.MotionEvent{}}
+	for _, ev := range events {
+		res.Events = append(res.Events, ev.meta(cam, loc, frames[ev.ID]))
+	}
+
+	httputil.SendJSON(writer, http.StatusOK, &APIResponse{Artifact: res})
+}
+
+// meta describes the event, and its frames (as from Images), for clients.
+func (ev *MotionEvent) meta(cam *Camera, loc *time.Location, frames []*Image) *messages.MotionEvent {
+	start := ev.Start.In(loc)
+	res := &messages.MotionEvent{
+		ID:         ev.ID,
+		Start:      ev.Start,
+		End:        ev.End,
+		Time:       start.Format("3:04pm"),
+		Date:       start.Format("Monday, 2 January, 2006"),
+		Frames:     ev.Frames,
+		Reviewed:   ev.Reviewed,
+		ReviewedBy: ev.ReviewedBy,
+		Images:     []*messages.ImageMeta{},
+	}
+	for _, img := range frames {
+		ts := img.Timestamp.In(loc)
+		meta := &messages.ImageMeta{
+			Camera:   cam.Name,
+			Handle:   img.Handle,
+			Time:     ts.Format("3:04pm"),
+			Date:     ts.Format("Monday, 2 January, 2006"),
+			HasVideo: img.HasVideo,
+		}
+		if img.Handle == ev.Still {
+			res.Still = meta
+		}
+		res.Images = append(res.Images, meta)
+	}
+	return res
+}
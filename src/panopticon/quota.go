@@ -0,0 +1,188 @@
+// Copyright © 2019 Dan Morrill
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panopticon
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"playground/log"
+)
+
+/*
+ * Quotas
+ *
+ * Retention is time-based, so a chatty camera can still fill the disk. To
+ * prevent that, the data files for all cameras (and optionally for individual
+ * cameras) can be held to a byte quota. Usage is the sum of the sizes of the
+ * data files recorded in the index.
+ *
+ * The quota is a high-water mark: once usage exceeds it, an eviction pass
+ * unpins media oldest-first until usage is back below QuotaLowWater (a
+ * fraction of the quota), so that a camera hovering at its limit doesn't
+ * trigger a pass on every upload. Collected images are sacrificed first, then
+ * recorded video, then motion, then generated. Anything pinned as MediaSaved
+ * is never evicted, even if that means remaining over quota.
+ *
+ * Passes run on a schedule, and also whenever an upload pushes usage over
+ * quota.
+ */
+
+// evictionOrder is the order in which kinds of media are sacrificed to get back under quota.
+var evictionOrder = []MediaKind{MediaCollected, MediaRecorded, MediaMotion, MediaGenerated}
+
+func (repo *RepositoryConfig) readyQuotas() {
+	var err error
+	if repo.Quota != "" {
+		if repo.quota, err = ParseSize(repo.Quota); err != nil {
+			panic(err)
+		}
+	}
+	repo.cameraQuotas = make(map[string]int64)
+	for camera, quota := range repo.CameraQuotas {
+		if quota == "" {
+			continue
+		}
+		if repo.cameraQuotas[camera], err = ParseSize(quota); err != nil {
+			panic(err)
+		}
+	}
+	if repo.QuotaLowWater == 0 {
+		repo.QuotaLowWater = 0.9
+	}
+	if repo.QuotaLowWater < 0 || repo.QuotaLowWater > 1 {
+		panic(fmt.Errorf("QuotaLowWater %f is not between 0 and 1", repo.QuotaLowWater))
+	}
+}
+
+// OverQuota indicates whether the indicated camera, or the repository as a whole, is using more
+// space than it's allowed.
+func (repo *RepositoryConfig) OverQuota(camera string) bool {
+	if quota, ok := repo.cameraQuotas[camera]; ok && quota > 0 && repo.usage(camera) > quota {
+		return true
+	}
+	return repo.quota > 0 && repo.usage() > repo.quota
+}
+
+// EnforceQuotas runs an eviction pass for each camera that is over its quota, and then for the
+// repository as a whole if it is over quota.
+func (repo *RepositoryConfig) EnforceQuotas() {
+	for camera, quota := range repo.cameraQuotas {
+		if quota > 0 && repo.usage(camera) > quota {
+			repo.evict(int64(float64(quota)*repo.QuotaLowWater), camera)
+		}
+	}
+	if repo.quota > 0 && repo.usage() > repo.quota {
+		repo.evict(int64(float64(repo.quota) * repo.QuotaLowWater))
+	}
+}
+
+// EnforceQuotasSoon starts an eviction pass in the background, unless one is already running.
+func (repo *RepositoryConfig) EnforceQuotasSoon() {
+	if !atomic.CompareAndSwapInt32(&repo.evicting, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&repo.evicting, 0)
+		defer func() {
+			if r := recover(); r != nil {
+				log.Error("RepositoryConfig.EnforceQuotasSoon", "panic in eviction", r)
+			}
+		}()
+		repo.EnforceQuotas()
+	}()
+}
+
+// EvictAt configures a job to enforce quotas each day at the indicated time.
+func (repo *RepositoryConfig) EvictAt(hour int, min int) {
+	go scheduler("evicter", hour, min, repo.EnforceQuotasSoon)
+}
+
+// evict unpins images from the indicated cameras (or all cameras if none are given) until their
+// usage is no more than `target` bytes. Unlike purging, this reclaims the data files immediately
+// rather than waiting on GC, since the point is to free space now.
+func (repo *RepositoryConfig) evict(target int64, cameras ...string) {
+	TAG := "RepositoryConfig.evict"
+
+	usage := repo.usage(cameras...)
+	start := usage
+	count := 0
+	for _, kind := range evictionOrder {
+		for usage > target {
+			candidates := repo.evictionCandidates(kind, 100, cameras...)
+			if len(candidates) < 1 {
+				break
+			}
+			for _, img := range candidates {
+				if usage <= target {
+					break
+				}
+				size := repo.diskSize(img)
+				repo.unpin(img, kind)
+				if repo.pinCount(img) == 0 {
+					repo.reclaim(img)
+					usage -= size
+				}
+				count++
+			}
+		}
+	}
+
+	if count > 0 {
+		repo.pruneMotionEvents()
+	}
+
+	log.Status(TAG, fmt.Sprintf("evicted %d pins from %v, freeing %d bytes", count, cameras, start-usage))
+	if usage > target {
+		log.Warn(TAG, fmt.Sprintf("still at %d bytes against target of %d after evicting everything eligible from %v", usage, target, cameras))
+	}
+}
+
+// reclaim deletes an image's data files (and any derivatives of them) and drops it from the index. It must already be unpinned.
+func (repo *RepositoryConfig) reclaim(img *Image) {
+	for _, ext := range mediaExtensions {
+		file := repo.canonFile(repo.dataPath(img.Source, fmt.Sprintf("%s.%s", img.Handle, ext)))
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			panic(err)
+		}
+	}
+	repo.removeDerivatives(img.Source, img.Handle)
+	repo.unindexImage(img)
+}
+
+// ParseSize parses a byte count, which may have a binary suffix of K, M, G, or T (e.g. "500M" or
+// "2T".)
+func ParseSize(size string) (int64, error) {
+	multiplier := int64(1)
+	trimmed := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(trimmed, suffix) {
+			multiplier = int64(1) << (10 * uint(i+1))
+			trimmed = strings.TrimSuffix(trimmed, suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(trimmed, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size '%s' (%s)", size, err)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("negative size '%s'", size)
+	}
+	return n * multiplier, nil
+}
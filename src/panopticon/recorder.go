@@ -0,0 +1,374 @@
+// Copyright © 2019 Dan Morrill
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panopticon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"playground/log"
+)
+
+/*
+ * Recording
+ *
+ * For a camera with an RTSPURL, the server can pull the camera's stream with
+ * an ffmpeg process, which does either or both of:
+ *   - extracting a still every FrameInterval seconds, which is handled as if
+ *     the camera had uploaded it, and pinned as MediaCollected
+ *   - recording the stream in SegmentLength-second pieces, pinned as
+ *     MediaRecorded with their first frames as their stills
+ * Segments are remuxed to MP4 as-is rather than re-encoded, which keeps the
+ * CPU cost low but means their video is only as playable as the camera's.
+ *
+ * ffmpeg writes into a spool directory, named by when each file was started.
+ * Since it writes files in order, a file is finished once a newer one of the
+ * same sort appears (or once ffmpeg exits), at which point it's moved into the
+ * repository.
+ *
+ * If ffmpeg exits -- the camera rebooted, the network dropped, etc. -- it's
+ * restarted after a delay, which doubles with each consecutive failure up to a
+ * limit, and resets once a run has stayed up for a while. As with still
+ * polling, recorders are reconciled against the camera list periodically,
+ * outcomes are recorded in CaptureStatus, and credentials go in the URL.
+ */
+
+// CaptureSourceRTSP identifies the recorder in CaptureStatus records.
+const CaptureSourceRTSP = "rtsp"
+
+const (
+	recorderMinBackoff    = 5 * time.Second
+	recorderMaxBackoff    = 5 * time.Minute
+	recorderStableAfter   = time.Minute // a run lasting this long resets the backoff
+	recorderStopTimeout   = 10 * time.Second
+	spoolScanInterval     = 5 * time.Second
+	spoolTimestampFormat  = "20060102-150405"
+	ffmpegTimestampFormat = "%Y%m%d-%H%M%S"
+)
+
+var recorders = &jobSet{running: make(map[string]chan struct{})}
+
+// startRecorders launches the job that keeps a recorder running for each camera that wants one.
+func (repo *RepositoryConfig) startRecorders() {
+	go func() {
+		for {
+			reconcileRecorders()
+			time.Sleep(pollReconcileInterval)
+		}
+	}()
+}
+
+// reconcileRecorders starts recorders for cameras that should have one, and stops those for cameras
+// that no longer should. A recorder is restarted if its camera's stream settings change.
+func reconcileRecorders() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("reconcileRecorders", "panic reconciling recorders", r)
+		}
+	}()
+
+	want := make(map[string]func(stop chan struct{}))
+	for _, cam := range System.Cameras() {
+		if cam.RTSPURL == "" || (cam.FrameInterval <= 0 && cam.SegmentLength <= 0) {
+			continue
+		}
+		key := fmt.Sprintf("%s %s %d %d", cam.ID, cam.RTSPURL, cam.FrameInterval, cam.SegmentLength)
+		c := cam
+		want[key] = func(stop chan struct{}) { record(c, stop) }
+	}
+	recorders.sync(want)
+}
+
+// record runs ffmpeg against the camera's stream until told to stop, restarting it as necessary.
+func record(cam *Camera, stop chan struct{}) {
+	TAG := "recorder"
+
+	log.Status(TAG, fmt.Sprintf("starting recorder for '%s'", cam.ID))
+	defer log.Status(TAG, fmt.Sprintf("stopped recorder for '%s'", cam.ID))
+
+	spool, err := ioutil.TempDir("", fmt.Sprintf("panopticon-%s-", cam.ID))
+	if err != nil {
+		log.Error(TAG, fmt.Sprintf("failed to create spool directory for '%s'", cam.ID), err)
+		recordCapture(cam.ID, CaptureSourceRTSP, err)
+		<-stop
+		return
+	}
+	defer func() {
+		if err := os.RemoveAll(spool); err != nil {
+			log.Error(TAG, fmt.Sprintf("failed to remove spool '%s'", spool), err)
+		}
+	}()
+
+	backoff := recorderMinBackoff
+	for {
+		started := time.Now()
+		err := runRecorder(cam, spool, stop)
+		collectSpool(cam.ID, spool, true)
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if time.Since(started) > recorderStableAfter {
+			backoff = recorderMinBackoff
+		}
+		if err == nil {
+			err = fmt.Errorf("stream ended")
+		}
+		log.Warn(TAG, fmt.Sprintf("ffmpeg for '%s' exited; restarting in %s", cam.ID, backoff), err)
+		recordCapture(cam.ID, CaptureSourceRTSP, err)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > recorderMaxBackoff {
+			backoff = recorderMaxBackoff
+		}
+	}
+}
+
+// recorderArgs constructs the ffmpeg command line for recording the camera's stream into `spool`.
+func recorderArgs(cam *Camera, spool string) []string {
+	args := streamInputArgs(cam.RTSPURL)
+
+	if cam.FrameInterval > 0 {
+		args = append(args, "-map", "0:v:0", "-vf", fmt.Sprintf("fps=1/%d", cam.FrameInterval), "-q:v", "2",
+			"-f", "image2", "-strftime", "1", filepath.Join(spool, fmt.Sprintf("frame-%s.jpg", ffmpegTimestampFormat)))
+	}
+	if cam.SegmentLength > 0 {
+		args = append(args, "-map", "0:v:0", "-c", "copy", "-f", "segment", "-segment_time", strconv.Itoa(cam.SegmentLength),
+			"-segment_format", "mp4", "-reset_timestamps", "1", "-strftime", "1",
+			filepath.Join(spool, fmt.Sprintf("segment-%s.mp4", ffmpegTimestampFormat)))
+	}
+	return args
+}
+
+// streamInputArgs constructs the beginning of an ffmpeg command line that reads from a camera's stream.
+// RTSP is pulled over TCP, since dropped UDP packets make for smeared frames.
+func streamInputArgs(rawURL string) []string {
+	args := []string{"-nostdin", "-loglevel", "error"}
+	if strings.HasPrefix(strings.ToLower(rawURL), "rtsp") {
+		args = append(args, "-rtsp_transport", "tcp")
+	}
+	return append(args, "-i", rawURL)
+}
+
+// runRecorder runs a single ffmpeg process for the camera, collecting its output as it goes, until
+// the process exits or the recorder is told to stop. Returns why ffmpeg exited, if it failed.
+func runRecorder(cam *Camera, spool string, stop chan struct{}) error {
+	TAG := "runRecorder"
+
+	stderr := &tailWriter{max: 2048}
+	cmd := exec.Command("ffmpeg", recorderArgs(cam, spool)...)
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Debug(TAG, fmt.Sprintf("started ffmpeg for '%s' from %s", cam.ID, redactURL(cam.RTSPURL)))
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	ticker := time.NewTicker(spoolScanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				// ffmpeg names the input, credentials and all, in most complaints about it
+				line := strings.Replace(stderr.lastLine(), cam.RTSPURL, redactURL(cam.RTSPURL), -1)
+				return fmt.Errorf("%s: %s", err, line)
+			}
+			return nil
+		case <-ticker.C:
+			collectSpool(cam.ID, spool, false)
+		case <-stop:
+			// ffmpeg finishes the file it's writing on interrupt, so give it a chance before killing it
+			cmd.Process.Signal(os.Interrupt)
+			select {
+			case <-done:
+			case <-time.After(recorderStopTimeout):
+				cmd.Process.Kill()
+				<-done
+			}
+			return nil
+		}
+	}
+}
+
+// collectSpool moves finished frames and segments from the spool into the repository. If `final`,
+// ffmpeg has exited and so every file is considered finished.
+func collectSpool(camID string, spool string, final bool) {
+	TAG := "collectSpool"
+
+	cam := System.GetCamera(camID)
+	if cam == nil {
+		return
+	}
+
+	entries, err := ioutil.ReadDir(spool) // sorted by name, and so by time
+	if err != nil {
+		log.Error(TAG, fmt.Sprintf("failed to read spool '%s'", spool), err)
+		return
+	}
+	var frames, segments []string
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case strings.HasPrefix(name, "frame-") && strings.HasSuffix(name, ".jpg"):
+			frames = append(frames, name)
+		case strings.HasPrefix(name, "segment-") && strings.HasSuffix(name, ".mp4"):
+			segments = append(segments, name)
+		}
+	}
+	if !final {
+		// the newest of each is still being written
+		if len(frames) > 0 {
+			frames = frames[:len(frames)-1]
+		}
+		if len(segments) > 0 {
+			segments = segments[:len(segments)-1]
+		}
+	}
+
+	for _, name := range frames {
+		collectSpooled(cam, filepath.Join(spool, name), collectFrame)
+	}
+	for _, name := range segments {
+		collectSpooled(cam, filepath.Join(spool, name), collectSegment)
+	}
+}
+
+// collectSpooled hands a spooled file to `collect`, recording the outcome and then removing it.
+func collectSpooled(cam *Camera, file string, collect func(*Camera, string, time.Time) error) {
+	var err error
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+		if err != nil {
+			log.Warn("collectSpooled", fmt.Sprintf("discarding '%s' from '%s'", filepath.Base(file), cam.ID), err)
+		}
+		recordCapture(cam.ID, CaptureSourceRTSP, err)
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			log.Error("collectSpooled", fmt.Sprintf("failed to remove spooled '%s'", file), err)
+		}
+	}()
+
+	// file names are e.g. frame-20190525-142311.jpg, in local time
+	base := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	captured, err := time.ParseInLocation(spoolTimestampFormat, base[strings.Index(base, "-")+1:], time.Local)
+	if err != nil {
+		return
+	}
+	err = collect(cam, file, captured)
+}
+
+// collectFrame stores a still extracted from the camera's stream, as if the camera had uploaded it.
+func collectFrame(cam *Camera, file string, captured time.Time) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	_, err = ingest(cam, b, captured, MediaCollected)
+	return err
+}
+
+// collectSegment stores a segment of video recorded from the camera's stream, with its first frame as
+// its still.
+func collectSegment(cam *Camera, file string, captured time.Time) error {
+	TAG := "collectSegment"
+
+	// as with uploads, diurnal cameras don't record at night
+	if cam.IsDark() {
+		return nil
+	}
+
+	// this also weeds out segments left unplayable by ffmpeg dying mid-write
+	still, err := extractFrame(file)
+	if err != nil {
+		return fmt.Errorf("unable to extract a still from segment (%v)", err)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	img := Repository.Store(cam.ID, still, captured)
+	if img.HasRendition("mp4") {
+		log.Warn(TAG, fmt.Sprintf("'%s' already has a segment; discarding duplicate", img.Handle))
+		return nil
+	}
+	img.LinkRendition("mp4", b)
+	img.Pin(MediaRecorded)
+	cam.noteImage()
+	if Repository.OverQuota(cam.ID) {
+		Repository.EnforceQuotasSoon()
+	}
+	return nil
+}
+
+// extractFrame returns the first frame of a video file as a JPEG.
+func extractFrame(file string) ([]byte, error) {
+	still, err := exec.Command("ffmpeg", "-nostdin", "-loglevel", "error", "-i", file, "-frames:v", "1", "-f", "image2", "-c:v", "mjpeg", "-").Output()
+	if err != nil {
+		return nil, err
+	}
+	if len(still) == 0 {
+		return nil, fmt.Errorf("no frames in '%s'", file)
+	}
+	return still, nil
+}
+
+// redactURL renders a URL with any password elided, for logging.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "(unparseable URL)"
+	}
+	return u.Redacted()
+}
+
+// tailWriter keeps only the last `max` bytes written to it, e.g. to report why a long-running process
+// died without accumulating everything it ever complained about.
+type tailWriter struct {
+	buf []byte
+	max int
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+// lastLine returns the last non-blank line written.
+func (t *tailWriter) lastLine() string {
+	lines := strings.Split(strings.TrimSpace(string(t.buf)), "\n")
+	return lines[len(lines)-1]
+}
@@ -22,8 +22,8 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
-	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -32,15 +32,68 @@ import (
 
 // RepositoryConfig contains photos. Essentially it owns and oversees the directory where photos are stored.
 type RepositoryConfig struct {
-	BaseDirectory   string
-	RetentionPeriod string
-	Latitude        string
-	Longitude       string
-	DefaultImage    string
+	BaseDirectory string
+
+	// default retention periods, per ParseRetention; individual cameras may override these
+	CollectedRetention string
+	MotionRetention    string
+	RetentionPeriod    string // for generated media
+	RecordedRetention  string
+
+	// byte quotas (per ParseSize) on data files, overall and for specific cameras by ID; an empty
+	// or missing quota means unlimited. See quota.go.
+	Quota         string
+	CameraQuotas  map[string]string
+	QuotaLowWater float64
+
+	quota        int64
+	cameraQuotas map[string]int64
+	evicting     int32
+
+	// if set, timelapses are also rendered as H.264 MP4 (via ffmpeg), for clients that can't play WebM
+	TimelapseMP4 bool
+
+	// if set, new images are labeled by running this command (see classify.go)
+	ClassifierCommand []string
+
+	Latitude     string
+	Longitude    string
+	DefaultImage string
 }
 
-// Ready prepares the RepositoryConfig for use.
+// Ready prepares the RepositoryConfig for use, and starts its background jobs (purging, timelapses,
+// etc.)
 func (repo *RepositoryConfig) Ready() {
+	repo.Prepare()
+
+	repo.PurgeAt(4, 0)
+	repo.EvictAt(4, 30)
+	repo.VacuumAt(4, 45)
+
+	repo.startTimelapser(0, 0)
+	repo.startPollers()
+	repo.startRecorders()
+	repo.startMonitor()
+
+	if len(repo.ClassifierCommand) > 0 {
+		SetClassifier(&CommandClassifier{Command: repo.ClassifierCommand})
+	}
+}
+
+// Prepare validates the configuration and brings the index up to date, but does not start any
+// background jobs. This is what command-line tools that operate on the repository should use.
+func (repo *RepositoryConfig) Prepare() {
+	repo.PrepareReadOnly()
+
+	if repo.indexStale() {
+		repo.Reindex()
+	}
+}
+
+// PrepareReadOnly is like Prepare, but only validates the configuration, leaving the index and the
+// image tree untouched. This is for tools that only inspect the repository, possibly while the
+// server is running.
+func (repo *RepositoryConfig) PrepareReadOnly() {
 	if repo.BaseDirectory == "" {
 		panic("empty BaseDirectory")
 	}
@@ -50,189 +103,173 @@ func (repo *RepositoryConfig) Ready() {
 		panic(err)
 	}
 
-	repo.PurgeAt(4, 0, "24h", MediaCollected)
-	repo.PurgeAt(4, 15, "24h", MediaMotion)
-	repo.PurgeAt(4, 30, repo.RetentionPeriod, MediaGenerated)
-	repo.VacuumAt(4, 45)
+	if repo.CollectedRetention == "" {
+		repo.CollectedRetention = "24h"
+	}
+	if repo.MotionRetention == "" {
+		repo.MotionRetention = "24h"
+	}
+	if repo.RetentionPeriod == "" {
+		repo.RetentionPeriod = "14d"
+	}
+	if repo.RecordedRetention == "" {
+		repo.RecordedRetention = "3d"
+	}
+	for _, retention := range []string{repo.CollectedRetention, repo.MotionRetention, repo.RetentionPeriod, repo.RecordedRetention} {
+		if _, err := ParseRetention(retention); err != nil {
+			panic(err)
+		}
+	}
 
-	repo.startTimelapser(0, 0)
+	repo.readyQuotas()
 }
 
 // Store updates the latest image for the given source (camera.) The provided image data will be
 // stored to disk, and will replace the previous in-RAM copy as latest from that source. The
-// `handle` returned can be used to refer to the image later, e.g. for lookups.
-func (repo *RepositoryConfig) Store(source string, data []byte) *Image {
-	return CreateImage(source, data)
+// `handle` returned can be used to refer to the image later, e.g. for lookups. `captured` is the
+// time the image was taken, or zero if unknown.
+func (repo *RepositoryConfig) Store(source string, data []byte, captured time.Time) *Image {
+	return CreateImage(source, data, captured)
 }
 
 // Latest retrieves the most recent image data received from the indicated source.
 func (repo *RepositoryConfig) Latest(source string) *Image {
-	var res *Image
-
-	for _, kind := range []MediaKind{MediaCollected, MediaMotion} {
-		for _, img := range repo.ListKind(source, kind) {
-			if res == nil {
-				res = img
-				continue
-			}
-			if img.Timestamp.After(res.Timestamp) {
-				res = img
-			}
-		}
+	imgs := repo.queryPins(source, []MediaKind{MediaCollected, MediaMotion}, time.Time{}, time.Time{}, 1)
+	if len(imgs) < 1 {
+		return nil
 	}
-
-	return res
+	return imgs[0]
 }
 
 // Recents returns recent photo activity. It will return up to 7 most recent
 // images (collected or motion), and up to 4 most recent of the others.
 func (repo *RepositoryConfig) Recents(camera string) (recents []*Image, saved []*Image, generated []*Image, motion []*Image) {
-	TAG := "RepositoryConfig.Recents"
-
 	cam := System.GetCamera(camera)
 	if cam == nil {
 		panic(fmt.Errorf("unknown camera '%s'", camera))
 	}
 
-	for _, kind := range AllKinds {
-		for _, img := range repo.ListKind(camera, kind) {
-			switch kind {
-			case MediaMotion:
-				motion = append(motion, img)
-				fallthrough
-			case MediaCollected: // recents is a *mix* of collected + motion
-				recents = append(recents, img)
-			case MediaGenerated:
-				generated = append(generated, img)
-			case MediaSaved:
-				saved = append(saved, img)
-			default:
-				log.Warn(TAG, "unknown media kind?!", kind)
-			}
-		}
-	}
-
-	// note that these need to be sorted in descending order by date, so the comparator is backward
-	sort.Slice(recents, func(i, j int) bool { return recents[i].Timestamp.After(recents[j].Timestamp) })
-	sort.Slice(saved, func(i, j int) bool { return saved[i].Timestamp.After(saved[j].Timestamp) })
-	sort.Slice(generated, func(i, j int) bool { return generated[i].Timestamp.After(generated[j].Timestamp) })
-	sort.Slice(motion, func(i, j int) bool { return motion[i].Timestamp.After(motion[j].Timestamp) })
-
-	if len(recents) > 7 {
-		recents = recents[:7]
-	}
-	if len(saved) > 4 {
-		saved = saved[:4]
-	}
-	if len(motion) > 4 {
-		motion = motion[:4]
-	}
-	if len(generated) > 4 {
-		generated = generated[:4]
-	}
+	// all of these are sorted in descending order by date
+	recents = repo.queryPins(camera, []MediaKind{MediaCollected, MediaMotion}, time.Time{}, time.Time{}, 7) // recents is a *mix* of collected + motion
+	saved = repo.queryPins(camera, []MediaKind{MediaSaved}, time.Time{}, time.Time{}, 4)
+	generated = repo.queryPins(camera, []MediaKind{MediaGenerated}, time.Time{}, time.Time{}, 4)
+	motion = repo.queryPins(camera, []MediaKind{MediaMotion}, time.Time{}, time.Time{}, 4)
 
 	return
 }
 
 // Locate retrieves the bytes for the indicated image.
 func (repo *RepositoryConfig) Locate(handle string) *Image {
-	for _, kind := range AllKinds {
-		for _, camera := range System.Cameras() {
-			dir := repo.dirFor(camera.ID, kind)
-			f, err := os.Open(dir)
-			if err != nil {
-				panic(err)
-			}
-			defer f.Close()
-			entries, err := f.Readdir(0)
-			if err != nil {
-				panic(err)
-			}
-			for _, entry := range entries {
-				name := entry.Name()
-				if kind == MediaGenerated && strings.Split(name, ".")[1] != "jpg" {
-					continue
-				}
-				if strings.HasPrefix(name, handle) {
-					_, err := os.Stat(filepath.Join(dir, fmt.Sprintf("%s.webm", handle)))
-					hasVideo := (kind == MediaGenerated || err == nil)
-					return &Image{
-						Handle:    handle,
-						Source:    camera.ID,
-						Timestamp: entry.ModTime(),
-						HasVideo:  hasVideo,
-					}
-				}
-			}
-		}
-	}
-
-	return nil
+	return repo.lookup(handle)
 }
 
-// ListKind returns the handles of all images of the indicated kind, associated with the indicated source.
+// ListKind returns the handles of all images of the indicated kind, associated with the indicated
+// source, newest first.
 func (repo *RepositoryConfig) ListKind(source string, kind MediaKind) []*Image {
+	return repo.ListKindBetween(source, kind, time.Time{}, time.Time{})
+}
+
+// ListKindBetween is like ListKind, but limited to images captured within [from, to). A zero time
+// leaves that end of the range open.
+func (repo *RepositoryConfig) ListKindBetween(source string, kind MediaKind, from time.Time, to time.Time) []*Image {
 	if System.GetCamera(source) == nil {
 		panic(fmt.Errorf("attempt to list unknown camera '%s'", source))
 	}
 
-	images := []*Image{}
-	dir := repo.dirFor(source, kind)
-	f, err := os.Open(dir)
-	if err != nil {
-		panic(err)
+	return repo.queryPins(source, []MediaKind{kind}, from, to, 0)
+}
+
+// PurgeBefore removes all images stored prior to a given time. This is used to enforce a rolling
+// window of images.
+func (repo *RepositoryConfig) PurgeBefore(kind MediaKind, then time.Time) {
+	for _, camera := range System.Cameras() {
+		repo.purgeCameraBefore(camera.ID, kind, then)
 	}
-	defer f.Close()
-	entries, err := f.Readdir(0)
-	if err != nil {
-		panic(err)
+}
+
+func (repo *RepositoryConfig) purgeCameraBefore(camera string, kind MediaKind, then time.Time) {
+	for _, img := range repo.queryPins(camera, []MediaKind{kind}, time.Time{}, then, 0) {
+		repo.unpin(img, kind)
 	}
-	for _, entry := range entries {
-		s := strings.Split(entry.Name(), ".")
-		if s[1] != "jpg" {
-			// .webm files live alonside their .jpg still images, but we shouldn't return them as handles`
-			continue
+}
+
+// unpin removes the symlinks pinning an image as the indicated kind. The data files are left for GC.
+func (repo *RepositoryConfig) unpin(img *Image, kind MediaKind) {
+	dir := repo.dirFor(img.Source, kind)
+	for _, ext := range mediaExtensions {
+		file := repo.canonFile(filepath.Join(dir, fmt.Sprintf("%s.%s", img.Handle, ext)))
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			panic(err)
 		}
-		_, err := os.Stat(filepath.Join(dir, fmt.Sprintf("%s.webm", s[0])))
-		hasVideo := (kind == MediaGenerated || err == nil)
-		images = append(images, &Image{
-			Handle:    s[0],
-			Source:    source,
-			Timestamp: entry.ModTime(),
-			HasVideo:  hasVideo,
-		})
 	}
+	repo.unindexPin(img, kind)
+}
 
-	return images
+// Retention returns the retention period in effect for the indicated kind of media from the
+// indicated camera, i.e. the camera's own setting if it has a valid one, or else the repository
+// default. MediaSaved is never purged, and so has no retention period.
+func (repo *RepositoryConfig) Retention(camera *Camera, kind MediaKind) time.Duration {
+	defaults := map[MediaKind]string{
+		MediaCollected: repo.CollectedRetention,
+		MediaMotion:    repo.MotionRetention,
+		MediaGenerated: repo.RetentionPeriod,
+		MediaRecorded:  repo.RecordedRetention,
+	}
+	retention, ok := defaults[kind]
+	if !ok {
+		panic(fmt.Errorf("'%s' media has no retention period", kind))
+	}
+	if override := camera.Retention(kind); override != "" {
+		if _, err := ParseRetention(override); err != nil {
+			log.Error("RepositoryConfig.Retention", fmt.Sprintf("ignoring bad '%s' retention for '%s'", kind, camera.ID), err)
+		} else {
+			retention = override
+		}
+	}
+	dur, err := ParseRetention(retention)
+	if err != nil {
+		panic(err)
+	}
+	return dur
 }
 
-// PurgeBefore removes all images stored prior to a given time. This is used to enforce a rolling
-// window of images.
-func (repo *RepositoryConfig) PurgeBefore(kind MediaKind, then time.Time) {
+// PurgeExpired removes pins older than the applicable retention period, for each kind of media from
+// each camera, and cameras' offline gaps that are too old to report.
+func (repo *RepositoryConfig) PurgeExpired() {
+	now := time.Now()
 	for _, camera := range System.Cameras() {
-		dir := repo.dirFor(camera.ID, kind)
-		f, err := os.Open(dir)
-		if err != nil {
-			panic(err)
+		for _, kind := range []MediaKind{MediaCollected, MediaMotion, MediaGenerated, MediaRecorded} {
+			dur := repo.Retention(camera, kind)
+			log.Debug("RepositoryConfig.PurgeExpired", fmt.Sprintf("purging '%s' media for '%s' older than %s", kind, camera.ID, dur))
+			repo.purgeCameraBefore(camera.ID, kind, now.Add(-dur))
 		}
-		defer f.Close()
-		entries, err := f.Readdir(0)
-		if err != nil {
-			panic(err)
+	}
+	repo.pruneGaps(now)
+}
+
+// ParseRetention parses a retention period. In addition to everything accepted by
+// time.ParseDuration, this allows a leading count of days, such as "14d" or "1d12h".
+func ParseRetention(retention string) (time.Duration, error) {
+	var days time.Duration
+	if i := strings.Index(retention, "d"); i >= 0 {
+		n, err := strconv.Atoi(retention[:i])
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid day count in retention period '%s'", retention)
 		}
-		for _, entry := range entries {
-			if entry.IsDir() {
-				log.Warn("RepositoryConfig.PurgeBefore", fmt.Sprintf("encountered dir '%s' where it shouldn't be", dir))
-				continue
-			}
-			if entry.ModTime().Before(then) {
-				file := repo.canonFile(filepath.Join(dir, entry.Name()))
-				if err := os.Remove(file); err != nil {
-					panic(err)
-				}
-			}
+		days = time.Duration(n) * 24 * time.Hour
+		retention = retention[i+1:]
+		if retention == "" {
+			return days, nil
 		}
 	}
+	dur, err := time.ParseDuration(retention)
+	if err != nil {
+		return 0, err
+	}
+	if dur < 0 {
+		return 0, fmt.Errorf("negative retention period '%s'", retention)
+	}
+	return days + dur, nil
 }
 
 func scheduler(tag string, hour int, min int, job func()) {
@@ -255,14 +292,9 @@ func scheduler(tag string, hour int, min int, job func()) {
 	}
 }
 
-// PurgeAt configures a job to purge the indicated kind of image according to
-// the indicated retention period to run each day at the indicated time.
-func (repo *RepositoryConfig) PurgeAt(hour int, min int, retention string, kind MediaKind) {
-	dur, err := time.ParseDuration(retention) // e.g. "14d", "24h"
-	if err != nil {
-		panic(err)
-	}
-
+// PurgeAt configures a job to purge expired media, per each camera's retention policy, to run each
+// day at the indicated time.
+func (repo *RepositoryConfig) PurgeAt(hour int, min int) {
 	// a tiny function to encapsulate what we need to do when we reach our start time
 	job := func() {
 		defer func() {
@@ -271,8 +303,7 @@ func (repo *RepositoryConfig) PurgeAt(hour int, min int, retention string, kind
 			}
 		}()
 
-		when := time.Now().Add(-dur)
-		repo.PurgeBefore(kind, when)
+		repo.PurgeExpired()
 	}
 
 	go scheduler("purger", hour, min, job)
@@ -281,25 +312,13 @@ func (repo *RepositoryConfig) PurgeAt(hour int, min int, retention string, kind
 // GC deletes all leaf image files that are not pinned, i.e. it garbage collects.
 func (repo *RepositoryConfig) GC() {
 	TAG := "RepositoryConfig.Vacuum"
-	allImages := make(map[string]bool)
-	for _, cam := range System.Cameras() {
-		for _, kind := range AllKinds {
-			for _, img := range repo.ListKind(cam.ID, kind) {
-				allImages[img.Handle] = true
-			}
-		}
-	}
 
 	// loop over all raw disk files
-	shaRE := regexp.MustCompile("[a-fA-F0-9]{64}")
 	for _, cam := range System.Cameras() {
+		pinned := repo.pinnedHandles(cam.ID)
+
 		baseDir := repo.canonDir(filepath.Join(repo.BaseDirectory, cam.ID, MediaData))
-		base, err := os.Open(baseDir)
-		if err != nil {
-			panic(err)
-		}
-		defer base.Close()
-		entries, err := base.Readdir(0)
+		entries, err := readDirIfExists(baseDir)
 		if err != nil {
 			panic(err)
 		}
@@ -313,12 +332,7 @@ func (repo *RepositoryConfig) GC() {
 				continue
 			}
 			subdir := repo.canonDir(filepath.Join(baseDir, entry.Name()))
-			sd, err := os.Open(subdir)
-			if err != nil {
-				panic(err)
-			}
-			defer sd.Close()
-			leaves, err := sd.Readdir(0)
+			leaves, err := readDirIfExists(subdir)
 			if err != nil {
 				panic(err)
 			}
@@ -328,17 +342,17 @@ func (repo *RepositoryConfig) GC() {
 					continue
 				}
 				chunks := strings.Split(leaf.Name(), ".")
-				if len(chunks) != 3 {
+				if len(chunks) != 2 {
 					// not a file we know how to deal with
 					continue
 				}
 				handle := chunks[0]
-				if !shaRE.Match([]byte(handle)) {
+				if !handleRE.MatchString(handle) {
 					// not one of our sha256 filenames
 					log.Debug(TAG, fmt.Sprintf("skipping unrecognized file '%s'", leaf.Name()))
 					continue
 				}
-				if _, ok := allImages[handle]; ok {
+				if _, ok := pinned[handle]; ok {
 					// means it's pinned by one of the other MediaKinds
 					log.Debug(TAG, fmt.Sprintf("skipping pinned file '%s'", leaf.Name()))
 					continue
@@ -358,7 +372,11 @@ func (repo *RepositoryConfig) GC() {
 				log.Debug(TAG, fmt.Sprintf("removed unpinned file '%s'", canonPath))
 			}
 		}
+
+		repo.gcDerivatives(cam.ID, pinned)
 	}
+
+	repo.unindexOrphans()
 }
 
 // VacuumAt configures a job to vacuum/GC raw image files that are not pinned.
@@ -397,16 +415,9 @@ func (repo *RepositoryConfig) GenerateTimelapse(date time.Time, camera *Camera,
 	}
 
 	var next time.Time
-	images := repo.ListKind(camera.ID, kind)
-	candidates := []*Image{}
-	for _, img := range images {
-		if img.Timestamp.Before(start) || end.Before(img.Timestamp) {
-			continue
-		}
-		candidates = append(candidates, img)
-	}
+	candidates := repo.ListKindBetween(camera.ID, kind, start, end)
 	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Timestamp.Before(candidates[j].Timestamp) })
-	images = []*Image{}
+	images := []*Image{}
 	names := []string{}
 	for _, img := range candidates {
 		if img.Timestamp.Before(next) {
@@ -425,6 +436,22 @@ func (repo *RepositoryConfig) GenerateTimelapse(date time.Time, camera *Camera,
 		return
 	}
 
+	// the timelapse's video is linked to its still, so the still can't be one that already has a
+	// video of its own (e.g. a motion image with an uploaded clip); use the one nearest the middle
+	var still *Image
+	for i := 0; i < len(images) && still == nil; i++ {
+		for _, j := range []int{len(images)/2 - i, len(images)/2 + i} {
+			if j >= 0 && j < len(images) && !images[j].HasVideo {
+				still = images[j]
+				break
+			}
+		}
+	}
+	if still == nil {
+		log.Warn(TAG, fmt.Sprintf("every image for '%s' already has a video; no still for timelapse", camera.ID))
+		return
+	}
+
 	// create a temp dir to generate our timelapse in via shelling out to mencoder
 	dir, err := ioutil.TempDir("/tmp", "timelapse-")
 	if err != nil {
@@ -470,22 +497,58 @@ func (repo *RepositoryConfig) GenerateTimelapse(date time.Time, camera *Camera,
 		panic(err)
 	}
 
-	still := images[len(images)/2] // already checked len(images) > 0
+	var mp4Bytes []byte
+	if repo.TimelapseMP4 {
+		mp4Bytes = transcodeMP4(webm)
+	}
+
 	var buf bytes.Buffer
 	still.Retrieve(&buf)
 	stillBytes := buf.Bytes()
 
-	img := repo.Store(camera.ID, stillBytes)
+	img := repo.Store(camera.ID, stillBytes, still.Timestamp)
 	if img == nil {
 		log.Warn(TAG, fmt.Sprintf("nonerror result but nil image"))
 	} else {
 		img.LinkVideo(webmBytes)
+		if mp4Bytes != nil {
+			img.LinkRendition("mp4", mp4Bytes)
+		}
 	}
 	img.Pin(MediaGenerated)
+	publishImage(img, EventTimelapse, MediaGenerated)
 
 	log.Status(TAG, fmt.Sprintf("generated timelapse for '%s' from %d images", camera.ID, len(images)))
 }
 
+// transcodeMP4 renders an H.264 MP4 copy of a video, for clients that can't play WebM. Since that
+// copy is optional, failures are logged and result in nil rather than a panic.
+func transcodeMP4(src string) []byte {
+	TAG := "RepositoryConfig.transcodeMP4"
+
+	dest := strings.TrimSuffix(src, filepath.Ext(src)) + ".mp4"
+	args := "-y -loglevel error -i %s -c:v libx264 -pix_fmt yuv420p -profile:v main -movflags +faststart %s"
+	args = fmt.Sprintf(args, src, dest)
+	defer func() {
+		if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+			log.Error(TAG, fmt.Sprintf("failed to remove transcoded '%s'", dest), err)
+		}
+	}()
+
+	log.Debug(TAG, "starting ffmpeg with args", args)
+	if out, err := exec.Command("ffmpeg", strings.Split(args, " ")...).CombinedOutput(); err != nil {
+		log.Error(TAG, fmt.Sprintf("ffmpeg failed to transcode '%s': %s", src, string(out)), err)
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(dest)
+	if err != nil {
+		log.Error(TAG, fmt.Sprintf("failed to read transcoded '%s'", dest), err)
+		return nil
+	}
+	return b
+}
+
 func (repo *RepositoryConfig) startTimelapser(hour int, min int) {
 	job := func() {
 		for _, camera := range System.Cameras() {
@@ -539,20 +602,33 @@ func (repo *RepositoryConfig) startTimelapser(hour int, min int) {
  * MediaCollected via this creation of this file pointing to it as a symlink:
  * /path/to/images/dachacam/collected/feedfacedeadbeefcafebabef00db0a71337b00bc001b0a7.jpg
  *
- * Collected images are purged every 24 hours, via the removal of the symlink.
+ * Collected images are purged after 24 hours by default, via the removal of
+ * the symlink.
  *
  * Motion images are pushed in response to camera-side motion detection. They
- * are purged every 24 hours.
+ * are purged after 24 hours by default.
  *
  * Generated media -- basically timelapses -- are constructed daily per some
  * schedule. Only photos from collected and motion sets are eligible to be used
- * to generate images. Generated images are purged after 14 days.
+ * to generate images. Generated images are purged after 14 days by default.
+ *
+ * Recorded media are fixed-length segments of video pulled from a camera's
+ * RTSP stream (see recorder.go), each with its first frame as its still.
+ * They're purged after 3 days by default.
+ *
+ * These defaults are configurable on RepositoryConfig, and each camera may
+ * override them. Retention is measured from when an image was captured (as
+ * recorded in the index, and mirrored in the data file's mtime), not from
+ * when it was uploaded or pinned.
  *
  * Saved images are images flagged by the user for permanent retention. They
  * are, obviously, never purged.
  *
  * As above, any base data file not pinned via one of the other types is purged
  * on the next GC run.
+ *
+ * The tree is mirrored in the media index (see index.go), which is what
+ * lookups and listings actually consult.
  */
 
 func (repo *RepositoryConfig) segmentToMediaKind(segment string) MediaKind {
@@ -561,6 +637,7 @@ func (repo *RepositoryConfig) segmentToMediaKind(segment string) MediaKind {
 		"motion":    MediaMotion,
 		"pinned":    MediaSaved,
 		"generated": MediaGenerated,
+		"recorded":  MediaRecorded,
 	}[segment]
 	if !ok {
 		return MediaUnknown
@@ -569,13 +646,18 @@ func (repo *RepositoryConfig) segmentToMediaKind(segment string) MediaKind {
 }
 
 func (repo *RepositoryConfig) dataPath(source, filename string) string {
+	p := repo.canonDataPath(source, filename)
+	repo.assertDir(filepath.Dir(p))
+	return p
+}
+
+// canonDataPath is like dataPath, but does not create the intermediate directory.
+func (repo *RepositoryConfig) canonDataPath(source, filename string) string {
 	if len(filename) < 3 {
 		panic("filename is too short")
 	}
 	prefix := filename[:3]
-	dirPath := filepath.Join(repo.BaseDirectory, source, MediaData, prefix)
-	repo.assertDir(dirPath)
-	return filepath.Join(dirPath, filename)
+	return filepath.Join(repo.BaseDirectory, source, MediaData, prefix, filename)
 }
 
 func (repo *RepositoryConfig) canonDir(dirPath string) string {
@@ -0,0 +1,215 @@
+// Copyright © 2019 Dan Morrill
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panopticon
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"playground/log"
+)
+
+/*
+ * Derivatives
+ *
+ * The UI shows most images much smaller than they were captured, so it can
+ * request a resized copy instead of the original. Resized copies are generated
+ * on first request and cached at
+ * {{.BaseDirectory}}/{{.CameraID}}/{{.MediaCache}}/{{prefix}}/{{.Handle}}-w{{width}}.jpg,
+ * grouped the same way as data files. Since the handle is the hash of the
+ * original, a derivative never changes once written.
+ *
+ * Only a handful of widths are generated, to bound the number of copies of any
+ * one image; other requested widths are rounded up to the next one. Derivatives
+ * are never pinned, and are removed by GC along with their originals.
+ */
+
+// derivativeWidths are the widths at which resized copies of images are generated, in ascending order.
+var derivativeWidths = []int{160, 320, 640, 1280}
+
+// derivativeWidth rounds a requested width up to the nearest generated width. Returns 0 if the request
+// is larger than any of them, meaning the original should be used.
+func derivativeWidth(requested int) int {
+	for _, w := range derivativeWidths {
+		if requested <= w {
+			return w
+		}
+	}
+	return 0
+}
+
+func (repo *RepositoryConfig) derivativePath(source, handle string, width int) string {
+	return filepath.Join(repo.BaseDirectory, source, MediaCache, handle[:3], fmt.Sprintf("%s-w%d.jpg", handle, width))
+}
+
+// OpenResized is like Open, but opens a copy of the image scaled down to roughly `width` pixels
+// wide, generating it if necessary. If the image is already no wider than that, the original is
+// opened instead. The caller must close the file.
+func (img *Image) OpenResized(width int) *os.File {
+	width = derivativeWidth(width)
+	if width == 0 {
+		return img.Open()
+	}
+
+	diskPath := Repository.canonFile(Repository.derivativePath(img.Source, img.Handle, width))
+	if f, err := os.Open(diskPath); err == nil {
+		return f
+	} else if !os.IsNotExist(err) {
+		panic(err)
+	}
+
+	var orig bytes.Buffer
+	img.Retrieve(&orig)
+	src, _, err := image.Decode(bytes.NewReader(orig.Bytes()))
+	if err != nil {
+		panic(err)
+	}
+	if src.Bounds().Dx() <= width {
+		return img.Open()
+	}
+
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, downscale(src, width), &jpeg.Options{Quality: 85}); err != nil {
+		panic(err)
+	}
+
+	// write via a temp file, so that a concurrent request never sees a partial derivative
+	Repository.assertDir(filepath.Dir(diskPath))
+	tmp, err := ioutil.TempFile(filepath.Dir(diskPath), ".resize-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if _, err := tmp.Write(out.Bytes()); err != nil {
+		tmp.Close()
+		panic(err)
+	}
+	if err := tmp.Close(); err != nil {
+		panic(err)
+	}
+	if err := os.Rename(tmp.Name(), diskPath); err != nil {
+		panic(err)
+	}
+	log.Debug("Image.OpenResized", fmt.Sprintf("generated %d-wide derivative of '%s'", width, img.Handle))
+
+	f, err := os.Open(diskPath)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// downscale shrinks an image to the indicated width, preserving its aspect ratio. Each output pixel
+// is the average of the block of input pixels it covers, which is plenty for the modest reductions
+// thumbnails need.
+func downscale(src image.Image, width int) *image.RGBA {
+	b := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+
+	sw, sh := b.Dx(), b.Dy()
+	height := (sh*width + sw/2) / sw
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0, y1 := y*sh/height, (y+1)*sh/height
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := x*sw/width, (x+1)*sw/width
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			var r, g, bl, a, n int
+			for sy := y0; sy < y1; sy++ {
+				row := rgba.Pix[sy*rgba.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += int(p[0])
+					g += int(p[1])
+					bl += int(p[2])
+					a += int(p[3])
+					n++
+				}
+			}
+			d := dst.Pix[y*dst.Stride+x*4:]
+			d[0], d[1], d[2], d[3] = uint8(r/n), uint8(g/n), uint8(bl/n), uint8(a/n)
+		}
+	}
+
+	return dst
+}
+
+// removeDerivatives deletes any cached derivatives of an image.
+func (repo *RepositoryConfig) removeDerivatives(source, handle string) {
+	for _, width := range derivativeWidths {
+		file := repo.canonFile(repo.derivativePath(source, handle, width))
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			panic(err)
+		}
+	}
+}
+
+// gcDerivatives removes cached derivatives for a camera whose originals are no longer pinned.
+func (repo *RepositoryConfig) gcDerivatives(camera string, pinned map[string]bool) {
+	TAG := "RepositoryConfig.gcDerivatives"
+
+	cacheDir := repo.canonDir(filepath.Join(repo.BaseDirectory, camera, MediaCache))
+	entries, err := readDirIfExists(cacheDir)
+	if err != nil {
+		panic(err)
+	}
+	count := 0
+	for _, entry := range entries {
+		if !entry.IsDir() || len(entry.Name()) != 3 {
+			continue
+		}
+		subdir := repo.canonDir(filepath.Join(cacheDir, entry.Name()))
+		leaves, err := readDirIfExists(subdir)
+		if err != nil {
+			panic(err)
+		}
+		for _, leaf := range leaves {
+			if leaf.IsDir() || len(leaf.Name()) < 64 {
+				continue
+			}
+			handle := leaf.Name()[:64]
+			if !handleRE.MatchString(handle) || !strings.HasPrefix(leaf.Name()[64:], "-w") {
+				continue
+			}
+			if pinned[handle] {
+				continue
+			}
+			if err := os.Remove(repo.canonFile(filepath.Join(subdir, leaf.Name()))); err != nil {
+				panic(err)
+			}
+			count++
+		}
+	}
+	if count > 0 {
+		log.Debug(TAG, fmt.Sprintf("removed %d derivatives from '%s'", count, camera))
+	}
+}
@@ -20,10 +20,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"image/png"
+	"net/url"
+	"regexp"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"panopticon/messages"
+
 	"github.com/boombuler/barcode"
 	"github.com/boombuler/barcode/qr"
 	"github.com/bradfitz/latlong"
@@ -46,6 +52,31 @@ type Camera struct {
 	Latitude    float64
 	Longitude   float64
 	Private     bool
+
+	// per-kind retention periods (per ParseRetention) overriding the RepositoryConfig defaults; empty
+	// means use the default
+	RetainCollected string
+	RetainMotion    string
+	RetainGenerated string
+	RetainRecorded  string
+
+	// how often, in seconds, to fetch an image from StillURL (see poller.go), or for a camera without
+	// one, how often its camera client should capture one (see EnrollHandler); zero means never, or
+	// the client's own default
+	StillInterval int
+
+	// how often, in seconds, to extract a still from the RTSPURL stream, and how long the video
+	// segments recorded from it are; zero means don't (see recorder.go)
+	FrameInterval int
+	SegmentLength int
+
+	// how readily collected images are judged to show motion, from 1 to 100; zero means they aren't
+	// analyzed (see motion.go)
+	MotionSensitivity int
+
+	// what a camera client sends: "collected" for every image, or "motion" for only those showing
+	// motion (judged per MotionSensitivity); empty leaves it to the client
+	CaptureMode MediaKind
 }
 
 // Store records a new Camera to the database, or updates it if it already exists.
@@ -54,11 +85,14 @@ func (c *Camera) Store() {
 	defer cxn.Close()
 
 	q := `insert into Cameras 
-						(ID, Name, AspectRatio, Address, Diurnal, Dewarp, Latitude, Longitude, Timelapse, ImageURL, RTSPURL, Private) 
-						values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+						(ID, Name, AspectRatio, Address, Diurnal, Dewarp, Latitude, Longitude, Timelapse, ImageURL, RTSPURL, Private, RetainCollected, RetainMotion, RetainGenerated, StillInterval, RetainRecorded, FrameInterval, SegmentLength, MotionSensitivity, CaptureMode) 
+						values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 						on conflict(ID) do update set
 							Name=excluded.Name, AspectRatio=excluded.AspectRatio, Address=excluded.Address, Diurnal=excluded.Diurnal, Dewarp=excluded.Dewarp, 
-							Latitude=excluded.Latitude, Longitude=excluded.Longitude, Timelapse=excluded.Timelapse, ImageURL=excluded.ImageURL, RTSPURL=excluded.RTSPURL, Private=excluded.Private`
+							Latitude=excluded.Latitude, Longitude=excluded.Longitude, Timelapse=excluded.Timelapse, ImageURL=excluded.ImageURL, RTSPURL=excluded.RTSPURL, Private=excluded.Private,
+							RetainCollected=excluded.RetainCollected, RetainMotion=excluded.RetainMotion, RetainGenerated=excluded.RetainGenerated, StillInterval=excluded.StillInterval,
+							RetainRecorded=excluded.RetainRecorded, FrameInterval=excluded.FrameInterval, SegmentLength=excluded.SegmentLength,
+							MotionSensitivity=excluded.MotionSensitivity, CaptureMode=excluded.CaptureMode`
 	diurnal := 0
 	if c.Diurnal {
 		diurnal = 1
@@ -71,7 +105,8 @@ func (c *Camera) Store() {
 	if c.Private {
 		private = 1
 	}
-	if _, err := cxn.Exec(q, c.ID, c.Name, c.Address, diurnal, dewarp, c.Timelapse, c.StillURL, c.RTSPURL, private); err != nil {
+	if _, err := cxn.Exec(q, c.ID, c.Name, c.AspectRatio, c.Address, diurnal, dewarp, c.Latitude, c.Longitude, c.Timelapse, c.StillURL, c.RTSPURL, private,
+		c.RetainCollected, c.RetainMotion, c.RetainGenerated, c.StillInterval, c.RetainRecorded, c.FrameInterval, c.SegmentLength, c.MotionSensitivity, c.CaptureMode); err != nil {
 		panic(err)
 	}
 }
@@ -85,6 +120,82 @@ func (c *Camera) Delete() {
 	if _, err := cxn.Exec("delete from Cameras where ID=?", c.ID); err != nil {
 		panic(err)
 	}
+	c.RevokeKeys()
+	c.CancelEnrollment()
+	c.clearCaptureStatus()
+	c.clearActivity()
+	c.clearBatches()
+	c.ClearMotionZones()
+	c.clearMotionEvents()
+}
+
+// cameraIDRE matches acceptable camera IDs. IDs are used as directory names, so they are limited to
+// characters that are safe there.
+var cameraIDRE = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]*$`)
+
+// Validate checks that the Camera's fields have acceptable values, returning an error describing the
+// first one that doesn't.
+func (c *Camera) Validate() error {
+	if !cameraIDRE.MatchString(c.ID) {
+		return fmt.Errorf("invalid camera ID '%s'", c.ID)
+	}
+	if strings.TrimSpace(c.Name) == "" {
+		return fmt.Errorf("camera '%s' has no name", c.ID)
+	}
+	switch AspectRatio(c.AspectRatio) {
+	case Aspect16x9, Aspect4x3:
+	default:
+		return fmt.Errorf("invalid aspect ratio '%s'", c.AspectRatio)
+	}
+	switch c.Timelapse {
+	case "", "none", MediaCollected, MediaMotion, "both":
+	default:
+		return fmt.Errorf("invalid timelapse kind '%s'", c.Timelapse)
+	}
+	if c.Latitude < -90 || c.Latitude > 90 {
+		return fmt.Errorf("latitude %f is out of range", c.Latitude)
+	}
+	if c.Longitude < -180 || c.Longitude > 180 {
+		return fmt.Errorf("longitude %f is out of range", c.Longitude)
+	}
+	for _, u := range []string{c.StillURL, c.RTSPURL} {
+		if parsed, err := url.Parse(u); u != "" && (err != nil || !parsed.IsAbs()) {
+			return fmt.Errorf("invalid URL '%s'", u)
+		}
+	}
+	if c.StillInterval < 0 || c.FrameInterval < 0 || c.SegmentLength < 0 {
+		return fmt.Errorf("negative capture interval or segment length")
+	}
+	if c.MotionSensitivity < 0 || c.MotionSensitivity > 100 {
+		return fmt.Errorf("motion sensitivity %d is out of range", c.MotionSensitivity)
+	}
+	if c.CaptureMode != "" && c.CaptureMode != MediaCollected && c.CaptureMode != MediaMotion {
+		return fmt.Errorf("invalid capture mode '%s'", c.CaptureMode)
+	}
+	for _, kind := range []MediaKind{MediaCollected, MediaMotion, MediaGenerated, MediaRecorded} {
+		if r := c.Retention(kind); r != "" {
+			if _, err := ParseRetention(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Retention returns the camera's retention override for the indicated kind, or the empty string if
+// it has none.
+func (c *Camera) Retention(kind MediaKind) string {
+	switch kind {
+	case MediaCollected:
+		return c.RetainCollected
+	case MediaMotion:
+		return c.RetainMotion
+	case MediaGenerated:
+		return c.RetainGenerated
+	case MediaRecorded:
+		return c.RetainRecorded
+	}
+	return ""
 }
 
 // LocalDaylight returns current time, sunrise, and sunset for current moment, in the camera's local time.
@@ -98,7 +209,7 @@ func (c *Camera) LocalDaylight(on time.Time) (now time.Time, rise time.Time, set
 	if on.IsZero() {
 		now = time.Now().In(loc)
 	} else {
-		now = on
+		now = on.In(loc)
 	}
 
 	rise, set = sunrise.SunriseSunset(c.Latitude, c.Longitude, now.Year(), now.Month(), now.Day())
@@ -122,12 +233,17 @@ func (c *Camera) Location() *time.Location {
 // IsDark indicates whether the camera is currently offline/sleeping due to
 // darkness. If the camera is not diurnal, this always returns false.
 func (c *Camera) IsDark() bool {
+	return c.IsDarkAt(time.Time{})
+}
+
+// IsDarkAt is IsDark as of the indicated time, or as of now if it's zero.
+func (c *Camera) IsDarkAt(when time.Time) bool {
 	// if we're not diurnal, or if location is apparently nonsense, we're never dark
 	if !c.Diurnal || (c.Latitude == 0.0 && c.Longitude == 0.0) {
 		return false
 	}
 
-	now, rise, set := c.LocalDaylight(time.Time{})
+	now, rise, set := c.LocalDaylight(when)
 
 	return now.Before(rise) || now.After(set)
 }
@@ -140,12 +256,23 @@ type User struct {
 	Privileged bool
 }
 
+// Validate checks that the User's fields have acceptable values.
+func (u *User) Validate() error {
+	if at := strings.Index(u.Email, "@"); at < 1 || at == len(u.Email)-1 || strings.ContainsAny(u.Email, " \t\r\n") {
+		return fmt.Errorf("invalid email '%s'", u.Email)
+	}
+	if strings.TrimSpace(u.Name) == "" {
+		return fmt.Errorf("user '%s' has no name", u.Email)
+	}
+	return nil
+}
+
 // Store records a new User to the database, or updates it if it already exists.
 func (u *User) Store() {
 	cxn := System.getDB()
 	defer cxn.Close()
 
-	if _, err := cxn.Exec("insert into Users (Email, Name, Privileged) values (?, ?, ?) on conflict(email) do update set Name=excluded.Name, Privileged=excluded.Privileged", u.Email, u.Name); err != nil {
+	if _, err := cxn.Exec("insert into Users (Email, Name, Privileged) values (?, ?, ?) on conflict(email) do update set Name=excluded.Name, Privileged=excluded.Privileged", u.Email, u.Name, u.Privileged); err != nil {
 		panic(err)
 	}
 }
@@ -187,27 +314,94 @@ func (sys *SystemConfig) Users() []*User {
 }
 
 // SystemConfig abstracts the configuration database and also provides a central point for accessing
-// various runtime settings.
+// various runtime settings. The exported fields are the settings as given in config; the Settings
+// table can override them at runtime, so the values actually in effect must be read via Current.
 type SystemConfig struct {
-	HomeURL         string
-	ServiceName     string
-	SessionCookieID string
-	CameraIDHeader  string
-	PollInterval    int
-	SqlitePath      string
-	DefaultImage    string
+	HomeURL           string
+	ServiceName       string
+	SessionCookieID   string
+	CameraIDHeader    string
+	CaptureTimeHeader string
+	PollInterval      int
+	SqlitePath        string
+	DefaultImage      string
+
+	lock    sync.RWMutex
+	current *RuntimeSettings
+}
+
+// RuntimeSettings are the values in effect for the settings that can be changed at runtime via the
+// Settings table. A RuntimeSettings is never modified once published, so it's safe to hold on to.
+type RuntimeSettings struct {
+	HomeURL           string
+	ServiceName       string
+	SessionCookieID   string
+	CameraIDHeader    string
+	CaptureTimeHeader string
+	PollInterval      int
+	DefaultImage      string
 }
 
 // Ready prepares the instance for use, generally by bootstrapping config from its sqlite3 database.
-// Any values on the instance will be overwritten by the database, meaning the only field strictly
+// Any values on the instance will be overridden by the database, meaning the only field strictly
 // required for initialization is the sqlite3 file path.
 func (sys *SystemConfig) Ready() {
 	sys.initSchema()
+	sys.loadSettings()
+}
+
+// Current returns the settings currently in effect.
+func (sys *SystemConfig) Current() *RuntimeSettings {
+	sys.lock.RLock()
+	defer sys.lock.RUnlock()
+	if sys.current == nil {
+		return sys.configured()
+	}
+	return sys.current
+}
+
+// configured returns the settings as given in config, i.e. without anything from the Settings table.
+func (sys *SystemConfig) configured() *RuntimeSettings {
+	return &RuntimeSettings{
+		HomeURL:           sys.HomeURL,
+		ServiceName:       sys.ServiceName,
+		SessionCookieID:   sys.SessionCookieID,
+		CameraIDHeader:    sys.CameraIDHeader,
+		CaptureTimeHeader: sys.CaptureTimeHeader,
+		PollInterval:      sys.PollInterval,
+		DefaultImage:      sys.DefaultImage,
+	}
+}
+
+// stringSettings maps the keys of the Settings table to the string fields they set. SqlitePath is
+// specifically excluded, since it's needed to find the table in the first place.
+func (rs *RuntimeSettings) stringSettings() map[string]*string {
+	return map[string]*string{
+		"HomeURL":           &rs.HomeURL,
+		"ServiceName":       &rs.ServiceName,
+		"SessionCookieID":   &rs.SessionCookieID,
+		"CameraIDHeader":    &rs.CameraIDHeader,
+		"CaptureTimeHeader": &rs.CaptureTimeHeader,
+		"DefaultImage":      &rs.DefaultImage,
+	}
+}
+
+// intSettings is like stringSettings, but for int fields.
+func (rs *RuntimeSettings) intSettings() map[string]*int {
+	return map[string]*int{
+		"PollInterval": &rs.PollInterval,
+	}
+}
+
+// loadSettings builds the settings in effect from config overlaid with whatever is in the Settings
+// table, and then publishes them all at once, so that readers never see a mix of old and new values.
+// A setting removed from the table thus reverts to its value from config.
+func (sys *SystemConfig) loadSettings() {
+	rs := sys.configured()
 
 	cxn := sys.getDB()
 	defer cxn.Close()
 
-	// load settings table and overwrite anything we got from config with whatever is in the table
 	if rows, err := cxn.Query("select Key, Value from Settings"); err != nil {
 		panic(err)
 	} else {
@@ -219,38 +413,90 @@ func (sys *SystemConfig) Ready() {
 			if v == "" {
 				continue
 			}
-			victim, ok := map[string]*string{
-				"HomeURL":         &sys.HomeURL,
-				"ServiceName":     &sys.ServiceName,
-				"SessionCookieID": &sys.SessionCookieID,
-				"CameraIDHeader":  &sys.CameraIDHeader,
-				"DefaultImage":    &sys.DefaultImage,
-				// specifically exclude SqlitePath here
-			}[k]
-			if ok {
-				*victim = v
-			} else {
-				victim, ok := map[string]*int{
-					"PollInterval": &sys.PollInterval,
-				}[k]
-				if ok {
-					if intV, err := strconv.Atoi(v); err != nil {
-						panic(err) // shouldn't be listed as an int field but not have an int value
-					} else {
-						*victim = intV
-					}
-				}
+			if err := rs.applySetting(k, v); err != nil {
+				panic(err) // shouldn't be listed as an int field but not have an int value
 			}
 		}
 	}
+
+	sys.lock.Lock()
+	sys.current = rs
+	sys.lock.Unlock()
+}
+
+// applySetting sets the field corresponding to a key of the Settings table. Unknown keys are ignored.
+func (rs *RuntimeSettings) applySetting(k, v string) error {
+	if victim, ok := rs.stringSettings()[k]; ok {
+		*victim = v
+	} else if victim, ok := rs.intSettings()[k]; ok {
+		intV, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("setting '%s' requires an integer value, not '%s'", k, v)
+		}
+		*victim = intV
+	}
+	return nil
+}
+
+// Settings returns the current values of all the keys that may be set in the Settings table.
+func (sys *SystemConfig) Settings() map[string]string {
+	// the snapshot is never modified, but stringSettings takes pointers, so work on a copy
+	rs := *sys.Current()
+	ret := make(map[string]string)
+	for k, victim := range rs.stringSettings() {
+		ret[k] = *victim
+	}
+	for k, victim := range rs.intSettings() {
+		ret[k] = strconv.Itoa(*victim)
+	}
+	return ret
+}
+
+// ValidateSetting checks whether a value is acceptable for a key of the Settings table. The empty
+// string is always acceptable, and means to revert to the value from config.
+func (sys *SystemConfig) ValidateSetting(k, v string) error {
+	_, isString := (&RuntimeSettings{}).stringSettings()[k]
+	_, isInt := (&RuntimeSettings{}).intSettings()[k]
+	if !isString && !isInt {
+		return fmt.Errorf("unknown setting '%s'", k)
+	}
+	if v == "" {
+		return nil
+	}
+	switch k {
+	case "PollInterval":
+		if n, err := strconv.Atoi(v); err != nil || n < 1 {
+			return fmt.Errorf("PollInterval must be a positive number of seconds, not '%s'", v)
+		}
+	case "HomeURL":
+		if u, err := url.Parse(v); err != nil || !u.IsAbs() {
+			return fmt.Errorf("HomeURL must be an absolute URL, not '%s'", v)
+		}
+	case "SessionCookieID", "CameraIDHeader", "CaptureTimeHeader":
+		if strings.ContainsAny(v, " \t\r\n:;,=") {
+			return fmt.Errorf("%s must be a valid header or cookie name, not '%s'", k, v)
+		}
+	}
+	return nil
+}
+
+// SetSetting validates and stores a value in the Settings table, and applies it immediately. Setting
+// the empty string reverts to the value from config.
+func (sys *SystemConfig) SetSetting(k, v string) error {
+	if err := sys.ValidateSetting(k, v); err != nil {
+		return err
+	}
+
+	sys.writeDatabaseByQuery("insert into Settings (Key, Value) values (?, ?) on conflict(Key) do update set Value=excluded.Value", k, v)
+	sys.loadSettings()
+	return nil
 }
 
-// QR generates a `data:` URL encoding a PNG image of a QR code that itself encodes the various
-// system settings needed by a client to access this service. That is, this will generate a QR code
-// that a device app can scan to populate itself with the settings necessary to interact with this
-// service instance.
-func (sys *SystemConfig) QR(buf *bytes.Buffer) {
-	jsonBytes, err := json.Marshal(sys)
+// QR generates a PNG image of a QR code that itself encodes what a camera needs to enroll with this
+// service: its URL, and a one-time enrollment token (see enroll.go.) That is, this will generate a QR
+// code that a device app can scan to set itself up to interact with this service instance.
+func (sys *SystemConfig) QR(buf *bytes.Buffer, token string) {
+	jsonBytes, err := json.Marshal(&messages.Enrollment{ServiceURL: sys.Current().HomeURL, Token: token})
 	if err != nil {
 		panic(err)
 	}
@@ -274,7 +520,7 @@ func (sys *SystemConfig) Cameras() []*Camera {
 	cxn := sys.getDB()
 	defer cxn.Close()
 
-	if rows, err := cxn.Query("select Name, ID, AspectRatio, Address, Diurnal, Dewarp, Latitude, Longitude, Timelapse, ImageURL, RTSPURL, Private from Cameras"); err != nil {
+	if rows, err := cxn.Query("select Name, ID, AspectRatio, Address, Diurnal, Dewarp, Latitude, Longitude, Timelapse, ImageURL, RTSPURL, Private, RetainCollected, RetainMotion, RetainGenerated, StillInterval, RetainRecorded, FrameInterval, SegmentLength, MotionSensitivity, CaptureMode from Cameras"); err != nil {
 		panic(err)
 	} else {
 		defer rows.Close()
@@ -282,7 +528,8 @@ func (sys *SystemConfig) Cameras() []*Camera {
 		ret := []*Camera{}
 		for rows.Next() {
 			c := &Camera{}
-			rows.Scan(&c.Name, &c.ID, &c.AspectRatio, &c.Address, &c.Diurnal, &c.Dewarp, &c.Latitude, &c.Longitude, &c.Timelapse, &c.StillURL, &c.RTSPURL, &c.Private)
+			rows.Scan(&c.Name, &c.ID, &c.AspectRatio, &c.Address, &c.Diurnal, &c.Dewarp, &c.Latitude, &c.Longitude, &c.Timelapse, &c.StillURL, &c.RTSPURL, &c.Private,
+				&c.RetainCollected, &c.RetainMotion, &c.RetainGenerated, &c.StillInterval, &c.RetainRecorded, &c.FrameInterval, &c.SegmentLength, &c.MotionSensitivity, &c.CaptureMode)
 			if c.Name == "" || c.ID == "" {
 				panic(fmt.Errorf("camera entry stored with null fields '%s'/'%s'", c.ID, c.Name))
 			}
@@ -300,10 +547,11 @@ func (sys *SystemConfig) GetCamera(ID string) *Camera {
 	cxn := sys.getDB()
 	defer cxn.Close()
 
-	row := cxn.QueryRow("select Name, ID, AspectRatio, Address, Diurnal, Dewarp, Latitude, Longitude, Timelapse, ImageURL, RTSPURL, Private from Cameras where ID=?", ID)
+	row := cxn.QueryRow("select Name, ID, AspectRatio, Address, Diurnal, Dewarp, Latitude, Longitude, Timelapse, ImageURL, RTSPURL, Private, RetainCollected, RetainMotion, RetainGenerated, StillInterval, RetainRecorded, FrameInterval, SegmentLength, MotionSensitivity, CaptureMode from Cameras where ID=?", ID)
 
 	c := &Camera{}
-	err := row.Scan(&c.Name, &c.ID, &c.AspectRatio, &c.Address, &c.Diurnal, &c.Dewarp, &c.Latitude, &c.Longitude, &c.Timelapse, &c.StillURL, &c.RTSPURL, &c.Private)
+	err := row.Scan(&c.Name, &c.ID, &c.AspectRatio, &c.Address, &c.Diurnal, &c.Dewarp, &c.Latitude, &c.Longitude, &c.Timelapse, &c.StillURL, &c.RTSPURL, &c.Private,
+		&c.RetainCollected, &c.RetainMotion, &c.RetainGenerated, &c.StillInterval, &c.RetainRecorded, &c.FrameInterval, &c.SegmentLength, &c.MotionSensitivity, &c.CaptureMode)
 	if err == sql.ErrNoRows {
 		return nil
 	}
@@ -36,13 +36,26 @@ const (
 	MediaMotion              = "motion"
 	MediaSaved               = "saved"
 	MediaGenerated           = "generated"
+	MediaRecorded            = "recorded"
 	MediaData                = "data"
+	MediaCache               = "cache"
 	MediaUnknown             = ""
 )
 
 // AllKinds is simply a list of all legitimate MediaKind values, intended for use in `range`
-// statements, etc. Intentionally excludes MediaData, which is where actual bits are stored.
-var AllKinds = []MediaKind{MediaCollected, MediaMotion, MediaSaved, MediaGenerated}
+// statements, etc. Intentionally excludes MediaData, which is where actual bits are stored, and
+// MediaCache, which holds resized derivatives of them.
+var AllKinds = []MediaKind{MediaCollected, MediaMotion, MediaSaved, MediaGenerated, MediaRecorded}
+
+// IsValid indicates whether the MediaKind is one of AllKinds.
+func (kind MediaKind) IsValid() bool {
+	for _, k := range AllKinds {
+		if kind == k {
+			return true
+		}
+	}
+	return false
+}
 
 // AspectRatio enumerates all acceptable aspect ratios for camera images. It's used to format the UI properly for a given camera.
 type AspectRatio string
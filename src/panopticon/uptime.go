@@ -0,0 +1,318 @@
+// Copyright © 2019 Dan Morrill
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panopticon
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"panopticon/messages"
+
+	"playground/httputil"
+	"playground/log"
+)
+
+/*
+ * Uptime
+ *
+ * Every image stored from a camera -- uploaded, polled, or pulled from its
+ * stream -- records when it arrived. A camera's expected cadence is what it's
+ * configured for if the server captures from it, and otherwise is inferred
+ * from the spacing of its recent collected images. A camera is offline when
+ * nothing has arrived for several times its cadence, except while it's
+ * asleep for the night. Cameras that have no cadence (e.g. ones that only
+ * upload on motion) are never considered offline.
+ *
+ * A monitor job checks every camera each minute, and records each stretch of
+ * time a camera spends offline as a gap, from which its uptime over a period
+ * can be computed. Changes in whether a camera is offline or asleep are also
+ * announced to clients listening for events.
+ */
+
+const (
+	offlineFactor   = 3               // how many times its cadence a camera can go without an image
+	offlineMinimum  = 2 * time.Minute // ...but never less than this
+	cadenceSamples  = 20              // how many recent images to infer a cadence from
+	monitorInterval = time.Minute
+	maxUptimeDays   = 366 // how far back uptime can be reported, and so how long gaps are kept
+)
+
+// CameraGap is a period during which a camera was offline.
+type CameraGap struct {
+	Start time.Time
+	End   time.Time // zero if the camera is still offline
+}
+
+// CameraHealth describes whether a camera is keeping up with its expected cadence.
+type CameraHealth struct {
+	LastImage time.Time     // zero if no image has ever arrived
+	Cadence   time.Duration // zero if unknown
+	Offline   bool
+	Message   string
+}
+
+// noteImage records that an image from the camera has just been stored.
+func (c *Camera) noteImage() {
+	System.writeDatabaseByQuery(`insert into CameraActivity (Camera, LastImage) values (?, ?)
+		on conflict (Camera) do update set LastImage=excluded.LastImage`, c.ID, time.Now().UTC())
+}
+
+// LastImage returns when an image from the camera last arrived, or the zero time if none ever has.
+func (c *Camera) LastImage() time.Time {
+	cxn := System.getDB()
+	defer cxn.Close()
+
+	var last time.Time
+	err := cxn.QueryRow("select LastImage from CameraActivity where Camera=?", c.ID).Scan(&last)
+	if err == sql.ErrNoRows {
+		return time.Time{}
+	}
+	if err != nil {
+		panic(err)
+	}
+	return last.Local()
+}
+
+// Cadence returns how often the camera is expected to deliver an image, or zero if it isn't expected
+// to at any particular rate.
+func (c *Camera) Cadence() time.Duration {
+	var configured time.Duration
+	for _, secs := range []int{c.StillInterval, c.FrameInterval} {
+		if d := time.Duration(secs) * time.Second; d > 0 && (configured == 0 || d < configured) {
+			configured = d
+		}
+	}
+	if configured > 0 && (c.StillInterval > 0 && c.StillURL != "" || c.FrameInterval > 0 && c.RTSPURL != "") {
+		return configured
+	}
+
+	// otherwise use the median spacing of recent collected images, which isn't thrown off by the
+	// occasional outage or overnight gap
+	imgs := Repository.queryPins(c.ID, []MediaKind{MediaCollected}, time.Time{}, time.Time{}, cadenceSamples)
+	if len(imgs) < 3 {
+		return 0
+	}
+	gaps := []time.Duration{}
+	for i := 1; i < len(imgs); i++ {
+		gaps = append(gaps, imgs[i-1].Timestamp.Sub(imgs[i].Timestamp))
+	}
+	sort.Slice(gaps, func(i, j int) bool { return gaps[i] < gaps[j] })
+	return gaps[len(gaps)/2]
+}
+
+// Health reports whether the camera is offline, i.e. overdue for an image while not asleep.
+func (c *Camera) Health() *CameraHealth {
+	h := &CameraHealth{LastImage: c.LastImage(), Cadence: c.Cadence()}
+	if h.LastImage.IsZero() {
+		h.Message = "no images received yet"
+		return h
+	}
+	if h.Cadence <= 0 || c.IsDark() {
+		return h
+	}
+
+	since := time.Since(h.LastImage)
+	threshold := offlineFactor * h.Cadence
+	if threshold < offlineMinimum {
+		threshold = offlineMinimum
+	}
+	if since > threshold {
+		h.Offline = true
+		h.Message = fmt.Sprintf("no image for %s", humanDuration(since))
+	}
+	return h
+}
+
+// humanDuration renders a duration roughly, in the largest sensible unit, e.g. "14 minutes".
+func humanDuration(d time.Duration) string {
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s", unit)
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+	if m := int(d / time.Minute); m < 120 {
+		return plural(m, "minute")
+	}
+	if h := int(d / time.Hour); h < 48 {
+		return plural(h, "hour")
+	}
+	return plural(int(d/(24*time.Hour)), "day")
+}
+
+// startMonitor launches the job that tracks when cameras go offline and come back.
+func (repo *RepositoryConfig) startMonitor() {
+	go func() {
+		for {
+			time.Sleep(monitorInterval)
+			monitorCameras()
+		}
+	}()
+}
+
+// monitorCameras opens a gap for each camera that has gone offline, and closes the gap of each one
+// that has come back (or gone to sleep.)
+func monitorCameras() {
+	TAG := "monitorCameras"
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error(TAG, "panic monitoring cameras", r)
+		}
+	}()
+
+	for _, cam := range System.Cameras() {
+		health := cam.Health()
+		publishCameraState(cam, cam.IsDark(), health)
+		open := cam.openGap()
+		switch {
+		case health.Offline && open == nil:
+			// the gap began with the last image, unless the camera has since slept and woken up
+			start := health.LastImage
+			if cam.Diurnal && !(cam.Latitude == 0.0 && cam.Longitude == 0.0) {
+				if _, rise, _ := cam.LocalDaylight(time.Time{}); start.Before(rise) {
+					start = rise
+				}
+			}
+			System.writeDatabaseByQuery("insert into CameraGaps (Camera, Start) values (?, ?)", cam.ID, start.UTC())
+			log.Warn(TAG, fmt.Sprintf("camera '%s' is offline: %s", cam.ID, health.Message))
+		case !health.Offline && open != nil:
+			end := time.Now()
+			if health.LastImage.After(open.Start) {
+				end = health.LastImage
+			}
+			System.writeDatabaseByQuery("update CameraGaps set End=? where Camera=? and End is null", end.UTC(), cam.ID)
+			log.Status(TAG, fmt.Sprintf("camera '%s' is back after %s", cam.ID, humanDuration(end.Sub(open.Start))))
+		}
+	}
+}
+
+// openGap returns the gap the camera is currently in, if any.
+func (c *Camera) openGap() *CameraGap {
+	cxn := System.getDB()
+	defer cxn.Close()
+
+	g := &CameraGap{}
+	err := cxn.QueryRow("select Start from CameraGaps where Camera=? and End is null order by Start desc limit 1", c.ID).Scan(&g.Start)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		panic(err)
+	}
+	g.Start = g.Start.Local()
+	return g
+}
+
+// Gaps returns the periods during which the camera was offline that ended after `since` (or that
+// haven't ended), oldest first.
+func (c *Camera) Gaps(since time.Time) []*CameraGap {
+	cxn := System.getDB()
+	defer cxn.Close()
+
+	rows, err := cxn.Query("select Start, End from CameraGaps where Camera=? and (End is null or End > ?) order by Start", c.ID, since.UTC())
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	ret := []*CameraGap{}
+	for rows.Next() {
+		g := &CameraGap{}
+		var end sql.NullTime
+		if err := rows.Scan(&g.Start, &end); err != nil {
+			panic(err)
+		}
+		g.Start = g.Start.Local()
+		if end.Valid {
+			g.End = end.Time.Local()
+		}
+		ret = append(ret, g)
+	}
+	return ret
+}
+
+// pruneGaps forgets gaps that ended too long ago to be reported.
+func (repo *RepositoryConfig) pruneGaps(now time.Time) {
+	System.writeDatabaseByQuery("delete from CameraGaps where End < ?", now.Add(-maxUptimeDays*24*time.Hour).UTC())
+}
+
+// clearActivity forgets the camera's arrival and gap history, e.g. when it's deleted.
+func (c *Camera) clearActivity() {
+	System.writeDatabaseByQuery("delete from CameraActivity where Camera=?", c.ID)
+	System.writeDatabaseByQuery("delete from CameraGaps where Camera=?", c.ID)
+}
+
+// UptimeHandler handles /client/uptime/<camera>, which reports the camera's gaps over the last week,
+// or over the number of days in the optional `days` query parameter, and the fraction of that time
+// it spent online.
+func UptimeHandler(writer http.ResponseWriter, req *http.Request) {
+	TAG := "panopticon.UptimeHandler"
+	badReq := httputil.NewJSONAssertable(writer, TAG, http.StatusBadRequest, clientError)
+	notFound := httputil.NewJSONAssertable(writer, TAG, http.StatusNotFound, noSuchCamera)
+
+	camID := httputil.ExtractSegment(req.URL.Path, 3)
+	cam := System.GetCamera(camID)
+	notFound.Assert(cam != nil, "uptime requested for unknown camera '%s'", camID)
+	u := userFor(req)
+	notFound.Assert(!cam.Private || u.Privileged, "attempt by '%s' to access private '%s'", u.Email, cam.ID)
+
+	days := 7
+	if raw := req.URL.Query().Get("days"); raw != "" {
+		var err error
+		days, err = strconv.Atoi(raw)
+		badReq.Assert(err == nil && days > 0 && days <= maxUptimeDays, "invalid days '%s'", raw)
+	}
+
+	to := time.Now()
+	from := to.Add(-time.Duration(days) * 24 * time.Hour)
+	health := cam.Health()
+	res := &messages.Uptime{
+		Camera:    cam.ID,
+		From:      from,
+		To:        to,
+		LastImage: health.LastImage,
+		Offline:   health.Offline,
+		Message:   health.Message,
+		Gaps:      []*messages.Gap{},
+	}
+
+	var down time.Duration
+	for _, g := range cam.Gaps(from) {
+		start, end := g.Start, g.End
+		if end.IsZero() {
+			end = to
+		}
+		if start.Before(from) {
+			start = from
+		}
+		down += end.Sub(start)
+		res.Gaps = append(res.Gaps, &messages.Gap{Start: g.Start, End: g.End, Minutes: int(g.duration(to) / time.Minute)})
+	}
+	res.Uptime = 1 - float64(down)/float64(to.Sub(from))
+
+	httputil.SendJSON(writer, http.StatusOK, &APIResponse{Artifact: res})
+}
+
+// duration returns how long the gap lasted, or has lasted as of `now` if it hasn't ended.
+func (g *CameraGap) duration(now time.Time) time.Duration {
+	if g.End.IsZero() {
+		return now.Sub(g.Start)
+	}
+	return g.End.Sub(g.Start)
+}
@@ -0,0 +1,187 @@
+// Copyright © 2019 Dan Morrill
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panopticon
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+/*
+ * Motion Zones
+ *
+ * A camera can have named polygonal zones that limit which parts of the
+ * picture motion counts in, e.g. to ignore a road or trees blowing in the
+ * wind. Points are fractions of the image's width and height, measured from
+ * its top left, so zones don't depend on resolution.
+ *
+ * If a camera has any active "include" zones, only motion inside one of them
+ * counts; motion inside an active "exclude" zone never does. Zones apply to
+ * server-side motion detection, and also to motion uploads, which are
+ * dropped if what changed since the camera's previous image lies entirely
+ * outside its zones.
+ */
+
+const (
+	ZoneInclude = "include"
+	ZoneExclude = "exclude"
+)
+
+// MotionZone is a region of a camera's picture in which motion does or does not count.
+type MotionZone struct {
+	Name   string
+	Mode   string       // ZoneInclude or ZoneExclude
+	Active bool         // inactive zones are kept, but ignored
+	Points [][2]float64 // vertices, as (x, y) fractions of the image's width and height
+}
+
+// Validate checks that the MotionZone's fields have acceptable values.
+func (z *MotionZone) Validate() error {
+	if z.Name == "" {
+		return fmt.Errorf("zone has no name")
+	}
+	if z.Mode != ZoneInclude && z.Mode != ZoneExclude {
+		return fmt.Errorf("zone '%s' has unknown mode '%s'", z.Name, z.Mode)
+	}
+	if len(z.Points) < 3 {
+		return fmt.Errorf("zone '%s' has fewer than 3 points", z.Name)
+	}
+	for _, p := range z.Points {
+		if p[0] < 0 || p[0] > 1 || p[1] < 0 || p[1] > 1 {
+			return fmt.Errorf("zone '%s' has point (%f, %f) outside the image", z.Name, p[0], p[1])
+		}
+	}
+	return nil
+}
+
+// contains indicates whether a point, in the same terms as Points, is inside the zone.
+func (z *MotionZone) contains(x float64, y float64) bool {
+	inside := false
+	for i, j := 0, len(z.Points)-1; i < len(z.Points); j, i = i, i+1 {
+		xi, yi := z.Points[i][0], z.Points[i][1]
+		xj, yj := z.Points[j][0], z.Points[j][1]
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// MotionZones returns the camera's zones, in order by name.
+func (c *Camera) MotionZones() []*MotionZone {
+	cxn := System.getDB()
+	defer cxn.Close()
+
+	rows, err := cxn.Query("select Name, Mode, Active, Points from MotionZones where Camera=? order by Name", c.ID)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	ret := []*MotionZone{}
+	for rows.Next() {
+		z := &MotionZone{}
+		var active int
+		var points string
+		if err := rows.Scan(&z.Name, &z.Mode, &active, &points); err != nil {
+			panic(err)
+		}
+		z.Active = active != 0
+		if err := json.Unmarshal([]byte(points), &z.Points); err != nil {
+			panic(err)
+		}
+		ret = append(ret, z)
+	}
+	return ret
+}
+
+// StoreMotionZone adds a zone to the camera, replacing any existing one with the same name. The zone
+// should already have been validated.
+func (c *Camera) StoreMotionZone(z *MotionZone) {
+	points, err := json.Marshal(z.Points)
+	if err != nil {
+		panic(err)
+	}
+	active := 0
+	if z.Active {
+		active = 1
+	}
+	System.writeDatabaseByQuery(`insert into MotionZones (Camera, Name, Mode, Active, Points) values (?, ?, ?, ?, ?)
+		on conflict (Camera, Name) do update set Mode=excluded.Mode, Active=excluded.Active, Points=excluded.Points`,
+		c.ID, z.Name, z.Mode, active, string(points))
+}
+
+// DeleteMotionZone removes the named zone from the camera. Returns false if it had no such zone.
+func (c *Camera) DeleteMotionZone(name string) bool {
+	cxn := System.getDB()
+	defer cxn.Close()
+
+	res, err := cxn.Exec("delete from MotionZones where Camera=? and Name=?", c.ID, name)
+	if err != nil {
+		panic(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		panic(err)
+	}
+	return n > 0
+}
+
+// ClearMotionZones removes all of the camera's zones.
+func (c *Camera) ClearMotionZones() {
+	System.writeDatabaseByQuery("delete from MotionZones where Camera=?", c.ID)
+}
+
+// motionMask returns which cells of the motion grid (see motion.go) motion counts in, per the
+// camera's active zones, or nil if it has none, i.e. motion counts everywhere.
+func motionMask(zones []*MotionZone) []bool {
+	var include, exclude []*MotionZone
+	for _, z := range zones {
+		if !z.Active {
+			continue
+		}
+		if z.Mode == ZoneInclude {
+			include = append(include, z)
+		} else {
+			exclude = append(exclude, z)
+		}
+	}
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil
+	}
+
+	mask := make([]bool, 0, motionGridWidth*motionGridHeight)
+	for y := 0; y < motionGridHeight; y++ {
+		for x := 0; x < motionGridWidth; x++ {
+			// test the center of each cell
+			cx := (float64(x) + 0.5) / motionGridWidth
+			cy := (float64(y) + 0.5) / motionGridHeight
+			counts := len(include) == 0
+			for _, z := range include {
+				if z.contains(cx, cy) {
+					counts = true
+					break
+				}
+			}
+			for _, z := range exclude {
+				if counts && z.contains(cx, cy) {
+					counts = false
+				}
+			}
+			mask = append(mask, counts)
+		}
+	}
+	return mask
+}
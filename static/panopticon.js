@@ -42,6 +42,35 @@ const globals = new Vuex.Store({
     "current-camera": function(state, cam) {
       state.CurrentCamera = cam;
     },
+    "camera-event": function(state, evt) {
+      // applies an event from /client/events to the camera it concerns; CurrentCamera is one of
+      // Cameras, so it sees the update too
+      const c = state.Cameras.find((c) => c.ID == evt.Camera);
+      if (!c) {
+        return;
+      }
+      const prepend = (list, img, max) => [img].concat(list || []).slice(0, max);
+      if (evt.Type == "image") {
+        if (c.LatestHandle) {
+          c.Recent = prepend(c.Recent, { Handle: c.LatestHandle, HasVideo: false }, 6);
+        }
+        c.LatestHandle = evt.Image.Handle;
+        c.LatestTime = evt.Image.Time;
+        c.LatestDate = evt.Image.Date;
+        c.Offline = false;
+        c.Message = "";
+      } else if (evt.Type == "pin" && evt.Kind == "saved") {
+        c.Saved = prepend(c.Saved, evt.Image, 4);
+      } else if (evt.Type == "pin" && evt.Kind == "motion") {
+        c.Motion = prepend(c.Motion, evt.Image, 4);
+      } else if (evt.Type == "timelapse") {
+        c.Timelapse = prepend(c.Timelapse, evt.Image, 4);
+      } else if (evt.Type == "camera") {
+        c.Sleeping = evt.Sleeping;
+        c.Offline = evt.Offline;
+        c.Message = evt.Message || "";
+      }
+    },
   },
 });
 
@@ -153,9 +182,8 @@ const settings = Vue.component('settings', {
     axios.get("/api/config").then((res) => {
       if (res.data.Artifact) {
         this.serviceName = res.data.Artifact.ServiceName;
-        this.clientLimit = res.data.Artifact.ClientLimit;
-        this.clientCertDuration = res.data.Artifact.IssuedCertDuration;
-        this.whitelistedDomains = res.data.Artifact.WhitelistedDomains;
+        this.homeURL = res.data.Artifact.HomeURL;
+        this.pollInterval = res.data.Artifact.PollInterval;
       } else {
         this.error = res.data.Error ? res.data.Error : generalError;
       }
@@ -166,9 +194,8 @@ const settings = Vue.component('settings', {
   data: function() {
     return {
       serviceName: "",
-      clientLimit: "",
-      clientCertDuration: "",
-      whitelistedDomains: "",
+      homeURL: "",
+      pollInterval: "",
       xhrPending: false,
       error: { },
     };
@@ -179,19 +206,14 @@ const settings = Vue.component('settings', {
       this.$router.push(this.$store.state.DefaultPath);
     },
     submit: function() {
-      let whitelistedDomains = this.$str(""+this.whitelistedDomains).split(" ").filter(w => w != "");
+      // settings are all strings on the wire; the server validates them
       let payload = {
-        ServiceName: this.serviceName,
-        ClientLimit: parseInt(this.clientLimit),
-        IssuedCertDuration: parseInt(this.clientCertDuration),
-        WhitelistedDomains: whitelistedDomains,
+        ServiceName: this.$str(this.serviceName),
+        HomeURL: this.$str(this.homeURL),
+        PollInterval: this.$str(""+this.pollInterval),
       };
-      if (payload.ClientLimit == NaN) {
-        this.error = {Message: "Max clients must be a number.", Extra: "", Recoverable: true};
-        return;
-      }
-      if (payload.IssuedCertDuration == NaN) {
-        this.error = {Message: "Refresh period must be a number.", Extra: "", Recoverable: true};
+      if (payload.PollInterval != "" && isNaN(parseInt(payload.PollInterval))) {
+        this.error = {Message: "Refresh interval must be a number.", Extra: "", Recoverable: true};
         return;
       }
       axios.put("/api/config", json=payload).then((res) => {
@@ -210,6 +232,7 @@ const events = Vue.component('state-fetcher', {
   data: function() {
     return {
       refreshTimer: null,
+      eventSource: null,
     };
   },
   methods: {
@@ -240,7 +263,10 @@ const events = Vue.component('state-fetcher', {
     },
     startRefresh: function() {
       this.loadState();
-      this.refreshTimer = setInterval(() => { this.loadState(); }, 5000);
+      // with the event stream delivering changes, a full reload is only needed now and then to keep
+      // things like local time current; without it, poll as before
+      const interval = window.EventSource ? 60000 : 5000;
+      this.refreshTimer = setInterval(() => { this.loadState(); }, interval);
     },
     stopRefresh: function() {
       if (this.refreshTimer != null) {
@@ -248,6 +274,25 @@ const events = Vue.component('state-fetcher', {
         this.refreshTimer = null;
       }
     },
+    startEvents: function() {
+      if (!window.EventSource) {
+        return;
+      }
+      this.eventSource = new EventSource("/client/events");
+      // anything may have been missed while (re)connecting, so catch up
+      this.eventSource.onopen = () => { this.loadState(); };
+      for (let type of ["image", "pin", "timelapse", "camera"]) {
+        this.eventSource.addEventListener(type, (e) => {
+          this.$store.commit("camera-event", JSON.parse(e.data));
+        });
+      }
+    },
+    stopEvents: function() {
+      if (this.eventSource != null) {
+        this.eventSource.close();
+        this.eventSource = null;
+      }
+    },
   },
   watch: {
     '$route': function(to, from) {
@@ -258,9 +303,11 @@ const events = Vue.component('state-fetcher', {
   },
   mounted: function() {
     this.startRefresh();
+    this.startEvents();
   },
   beforeDestroy: function() {
     this.stopRefresh();
+    this.stopEvents();
   },
 });
 
@@ -292,10 +339,23 @@ const saveMixin = {
 const camera = Vue.component('camera', {
   template: "#camera",
   mixins: [apiMixin, errorMixin, saveMixin],
+  data: function() {
+    return {
+      live: false,
+    };
+  },
   methods: {
     changeCamera: function(cID) {
+      this.live = false;
       this.$router.push(`/camera/${cID}`);
     },
+    // heroImg is the latest image, or the camera's live MJPEG stream while live view is on
+    heroImg: function() {
+      if (this.live && this.$store.state.CurrentCamera.HasLive) {
+        return `/client/live/${this.$store.state.CurrentCamera.ID}`;
+      }
+      return this.currentImg();
+    },
     fetchImg: function(typ, slot) {
       if (this.$store.state.CurrentCamera == undefined || this.$store.state.CurrentCamera[typ] == undefined) {
         return undefined;
@@ -331,6 +391,13 @@ const playerMixin = {
       }
       return `/client/image/${this.img.Handle}`;
     },
+    // thumbSrc is a scaled-down copy of src, for rendering small; the viewer still opens src
+    thumbSrc: function() {
+      if (this.$str(this.img) == "") {
+        return this.$store.state.DefaultImage;
+      }
+      return `/client/image/${this.img.Handle}?w=320`;
+    },
   },
 };
 
@@ -412,6 +479,7 @@ const router = new VueRouter({
 
 Vue.prototype.$vvdefaults = {
   inline: false, button:false, title:false, rotatable:false, scalable:false, navbar: false, toolbar: false,
+  url: "data-original",
 };
 
 // helper function, because lolJavaScript